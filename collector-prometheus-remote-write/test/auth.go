@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// authentication schemes of the querier
+const (
+	noAuth     = "none"   // no authentication
+	basicAuth  = "basic"  // HTTP basic authentication with basicAuthUsername and basicAuthPassword
+	bearerAuth = "bearer" // the bearer token in bearerTokenFile
+	mtlsAuth   = "mtls"   // the client certificate in tlsCertFile and tlsKeyFile
+	sigv4Auth  = "sigv4"  // AWS sig v4 signing for awsService in awsRegion, with the default credential chain
+)
+
+var authSchemes = []string{noAuth, basicAuth, bearerAuth, mtlsAuth, sigv4Auth}
+
+// tenantHeader is the header Cortex reads the tenant of a request from
+const tenantHeader = "X-Scope-OrgID"
+
+// newQueryTransport returns the transport of the HTTP client used by the querier: the default transport with the TLS
+// options, authenticating each query with the queryAuth scheme and sending the tenantID
+func newQueryTransport() (http.RoundTripper, error) {
+	base, err := tlsTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = base
+	switch queryAuth {
+	case noAuth, mtlsAuth:
+		// the client certificate is part of the TLS config
+	case basicAuth:
+		transport = &basicAuthRoundTripper{transport, basicAuthUsername, basicAuthPassword}
+	case bearerAuth:
+		transport = &bearerTokenRoundTripper{transport, bearerTokenFile}
+	case sigv4Auth:
+		// the fake backend does not check signatures, so no AWS credentials are needed
+		if fakeCortexAddr == "" {
+			if transport, err = NewAuth(awsService, awsRegion, transport); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth %q, must be one of %s", queryAuth, strings.Join(authSchemes, ", "))
+	}
+
+	// set before signing, so that the tenant is signed as well
+	if tenantID != "" {
+		transport = &headerRoundTripper{transport, tenantHeader, tenantID}
+	}
+	return transport, nil
+}
+
+// tlsTransport returns a copy of the default transport that verifies the server with the CA certificate in tlsCAFile
+// and presents the client certificate in tlsCertFile and tlsKeyFile, if they are set
+func tlsTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCAFile == "" && tlsCertFile == "" {
+		return transport, nil
+	}
+
+	cfg := &tls.Config{}
+	if tlsCAFile != "" {
+		pem, err := ioutil.ReadFile(tlsCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", tlsCAFile)
+		}
+	}
+	if tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = cfg
+	return transport, nil
+}
+
+// basicAuthRoundTripper adds HTTP basic authentication to each request
+type basicAuthRoundTripper struct {
+	transport          http.RoundTripper
+	username, password string
+}
+
+// RoundTrip sends a copy of req with the credentials
+func (b *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(b.username, b.password)
+	return b.transport.RoundTrip(req)
+}
+
+// bearerTokenRoundTripper adds the bearer token in a file to each request. The file is read for every request, so that
+// the token can be rotated while the querier runs.
+type bearerTokenRoundTripper struct {
+	transport http.RoundTripper
+	tokenFile string
+}
+
+// RoundTrip sends a copy of req with the token
+func (b *bearerTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := ioutil.ReadFile(b.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return b.transport.RoundTrip(req)
+}
+
+// headerRoundTripper sets a header of each request
+type headerRoundTripper struct {
+	transport   http.RoundTripper
+	name, value string
+}
+
+// RoundTrip sends a copy of req with the header
+func (h *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(h.name, h.value)
+	return h.transport.RoundTrip(req)
+}
+
+// SigningRoundTripper is a Custom RoundTripper that performs AWS Sig V4
+type SigningRoundTripper struct {
+	transport http.RoundTripper
+	signer    *v4.Signer
+	cfg       *aws.Config
+	service   string
+}
+
+// RoundTrip signs each outgoing request
+func (si *SigningRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	// Sign the request
+	_, err := si.signer.Sign(req, nil, si.service, *si.cfg.Region, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// Send the request to Cortex
+	return si.transport.RoundTrip(req)
+}
+
+// NewAuth takes a map of strings as parameters and return a http.RoundTripper that perform Sig V4 signing on each
+// request.
+func NewAuth(service, region string, origTransport http.RoundTripper) (http.RoundTripper, error) {
+
+	// Initialize session with default credential chain
+	// https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+		aws.NewConfig().WithLogLevel(aws.LogDebugWithSigning),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = sess.Config.Credentials.Get(); err != nil {
+		return nil, err
+	}
+
+	// Get Credentials, either from ./aws or from environmental variables
+	creds := sess.Config.Credentials
+	signer := v4.NewSigner(creds)
+	signer.Debug = aws.LogDebugWithSigning
+	signer.Logger = aws.NewDefaultLogger()
+	rtp := SigningRoundTripper{
+		transport: origTransport,
+		signer:    signer,
+		cfg:       sess.Config,
+		service:   service,
+	}
+	// return a RoundTripper
+	return &rtp, nil
+}
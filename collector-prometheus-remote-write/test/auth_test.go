@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// headerServer starts a server that records the headers of the last request it received
+func headerServer() (*httptest.Server, func() http.Header) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	return srv, func() http.Header { return got }
+}
+
+// setAuth sets the auth options for a test, and returns a function that restores them
+func setAuth(auth, username, password, tokenFile, tenant string) func() {
+	saved := []string{queryAuth, basicAuthUsername, basicAuthPassword, bearerTokenFile, tenantID, tlsCAFile, tlsCertFile,
+		tlsKeyFile, fakeCortexAddr}
+	queryAuth, basicAuthUsername, basicAuthPassword, bearerTokenFile, tenantID = auth, username, password, tokenFile, tenant
+	tlsCAFile, tlsCertFile, tlsKeyFile, fakeCortexAddr = "", "", "", ""
+	return func() {
+		queryAuth, basicAuthUsername, basicAuthPassword, bearerTokenFile, tenantID = saved[0], saved[1], saved[2],
+			saved[3], saved[4]
+		tlsCAFile, tlsCertFile, tlsKeyFile, fakeCortexAddr = saved[5], saved[6], saved[7], saved[8]
+	}
+}
+
+// get sends a request to url through a client with the query transport, and returns the error of either
+func get(url string) error {
+	transport, err := newQueryTransport()
+	if err != nil {
+		return err
+	}
+	res, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// tempFile writes content to a file in dir and returns its path
+func tempFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_newQueryTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := tempFile(t, dir, "token", "token1\n")
+
+	tests := []struct {
+		name          string
+		auth          string
+		tenant        string
+		authorization string
+	}{
+		{"none", noAuth, "", ""},
+		{"basic", basicAuth, "", "Basic dXNlcjpwYXNz"},
+		{"bearer", bearerAuth, "", "Bearer token1"},
+		{"tenant", noAuth, "team-a", ""},
+		{"basic_tenant", basicAuth, "team-a", "Basic dXNlcjpwYXNz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, headers := headerServer()
+			defer srv.Close()
+			defer setAuth(tt.auth, "user", "pass", tokenFile, tt.tenant)()
+
+			if err := get(srv.URL); err != nil {
+				t.Fatal(err)
+			}
+			if got := headers().Get("Authorization"); got != tt.authorization {
+				t.Errorf("Authorization: got %q, want %q", got, tt.authorization)
+			}
+			if got := headers().Get(tenantHeader); got != tt.tenant {
+				t.Errorf("%s: got %q, want %q", tenantHeader, got, tt.tenant)
+			}
+		})
+	}
+
+	defer setAuth("kerberos", "", "", "", "")()
+	if _, err := newQueryTransport(); err == nil || !strings.Contains(err.Error(), `unknown auth "kerberos"`) {
+		t.Errorf("unknown auth: got %v", err)
+	}
+}
+
+func Test_bearerTokenRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := tempFile(t, dir, "token", "token1\n")
+
+	srv, headers := headerServer()
+	defer srv.Close()
+	defer setAuth(bearerAuth, "", "", tokenFile, "")()
+	transport, err := newQueryTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+
+	// the token file is read again for each request
+	for _, token := range []string{"token1", "token2"} {
+		tempFile(t, dir, "token", token+"\n")
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := headers().Get("Authorization"); got != "Bearer "+token {
+			t.Errorf("got %q, want %q", got, "Bearer "+token)
+		}
+	}
+
+	os.Remove(tokenFile)
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Error("got no error without a token file")
+	}
+}
+
+func Test_sigv4Tenant(t *testing.T) {
+	for name, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		"AWS_SESSION_TOKEN":     "",
+	} {
+		saved, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if ok {
+			defer os.Setenv(name, saved)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	srv, headers := headerServer()
+	defer srv.Close()
+	defer setAuth(sigv4Auth, "", "", "", "team-a")()
+	if err := get(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tenant header is set before the request is signed, so it is one of the signed headers
+	authorization := headers().Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 ") {
+		t.Fatalf("Authorization: got %q, want a sig v4 signature", authorization)
+	}
+	if !strings.Contains(authorization, strings.ToLower(tenantHeader)) {
+		t.Errorf("%s is not signed: %q", tenantHeader, authorization)
+	}
+	if got := headers().Get(tenantHeader); got != "team-a" {
+		t.Errorf("%s: got %q, want %q", tenantHeader, got, "team-a")
+	}
+}
+
+func Test_tlsTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setAuth(noAuth, "", "", "", "")()
+
+	tests := []struct {
+		name    string
+		caFile  string
+		wantErr string
+	}{
+		{"no_ca", "", ""},
+		{"not_pem", tempFile(t, dir, "ca.crt", "not a certificate\n"), "no certificates in"},
+		{"missing", filepath.Join(dir, "missing.crt"), "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCAFile = tt.caFile
+			transport, err := tlsTransport()
+			if tt.wantErr == "" {
+				if err != nil || transport.TLSClientConfig != nil && transport.TLSClientConfig.RootCAs != nil {
+					t.Errorf("got %v, want the system CAs", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// clientCertificate writes a self-signed client certificate of commonName and its key to dir, and returns the
+// certificate and the paths of both files
+func clientCertificate(t *testing.T, dir, commonName string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return cert, tempFile(t, dir, commonName+".crt", string(certPEM)), tempFile(t, dir, commonName+".key", string(keyPEM))
+}
+
+func Test_mtls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setAuth(mtlsAuth, "", "", "", "")()
+
+	// the server only accepts the client certificate of the querier, and records the one presented
+	cert, certFile, keyFile := clientCertificate(t, dir, "querier")
+	_, otherCertFile, otherKeyFile := clientCertificate(t, dir, "other")
+	var peer string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	srv.TLS.ClientCAs.AddCert(cert)
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := tempFile(t, dir, "ca.crt",
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+
+	tests := []struct {
+		name     string
+		caFile   string
+		certFile string
+		keyFile  string
+		wantErr  bool
+	}{
+		{"client_certificate", caFile, certFile, keyFile, false},
+		{"no_client_certificate", caFile, "", "", true},
+		{"unknown_client_certificate", caFile, otherCertFile, otherKeyFile, true},
+		{"unknown_server", "", certFile, keyFile, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCAFile, tlsCertFile, tlsKeyFile = tt.caFile, tt.certFile, tt.keyFile
+			peer = ""
+			err := get(srv.URL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && peer != "querier" {
+				t.Errorf("got client certificate %q, want %q", peer, "querier")
+			}
+		})
+	}
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix is prepended to the upper-cased flag name to get the environment variable of an option, e.g.
+// CORTEX_TEST_CORTEX_ENDPOINT for -cortex-endpoint
+const envPrefix = "CORTEX_TEST_"
+
+// config holds every option of the pipeline test. Options are resolved in the following order, each overriding the
+// previous one: default values in main.go, the YAML config file, environment variables, and command-line flags.
+type config struct {
+	CortexEndpoint      string        `yaml:"cortex_endpoint"`
+	QueryPath           string        `yaml:"query_path"`
+	FakeCortex          string        `yaml:"fake_cortex"`
+	InputPath           string        `yaml:"input_path"`
+	OutputPath          string        `yaml:"output_path"`
+	LatencyPath         string        `yaml:"latency_path"`
+	Items               int           `yaml:"items"`
+	Endpoint            string        `yaml:"endpoint"`
+	FakeCollector       string        `yaml:"fake_collector"`
+	HealthCheckEndpoint string        `yaml:"health_check_endpoint"`
+	ReadyTimeout        time.Duration `yaml:"ready_timeout"`
+	RequestTimeout      time.Duration `yaml:"request_timeout"`
+	WaitTime            time.Duration `yaml:"wait_time"`
+	IngestionTimeout    time.Duration `yaml:"ingestion_timeout"`
+	PollInterval        time.Duration `yaml:"poll_interval"`
+	QueryConcurrency    int           `yaml:"query_concurrency"`
+	CollectorConfig     string        `yaml:"collector_config"`
+	Namespace           string        `yaml:"namespace"`
+	ConstLabels         []string      `yaml:"const_labels"`
+	QueryRange          bool          `yaml:"query_range"`
+	QueryStart          string        `yaml:"query_start"`
+	QueryEnd            string        `yaml:"query_end"`
+	QueryStep           time.Duration `yaml:"query_step"`
+	Workers             int           `yaml:"workers"`
+	RequestRate         float64       `yaml:"request_rate"`
+	DataPointRate       float64       `yaml:"data_point_rate"`
+	Duration            time.Duration `yaml:"duration"`
+	Requests            int           `yaml:"requests"`
+	ReportInterval      time.Duration `yaml:"report_interval"`
+	BatchSize           int           `yaml:"batch_size"`
+	BatchDataPoints     int           `yaml:"batch_data_points"`
+	FlushInterval       time.Duration `yaml:"flush_interval"`
+	AWSService          string        `yaml:"aws_service"`
+	AWSRegion           string        `yaml:"aws_region"`
+	Auth                string        `yaml:"auth"`
+	BasicAuthUsername   string        `yaml:"basic_auth_username"`
+	BasicAuthPassword   string        `yaml:"basic_auth_password"`
+	BearerTokenFile     string        `yaml:"bearer_token_file"`
+	TLSCAFile           string        `yaml:"tls_ca_file"`
+	TLSCertFile         string        `yaml:"tls_cert_file"`
+	TLSKeyFile          string        `yaml:"tls_key_file"`
+	TenantID            string        `yaml:"tenant_id"`
+	Labels              []string      `yaml:"labels"`
+	Bounds              []float64     `yaml:"bounds"`
+	BucketLayouts       []string      `yaml:"bucket_layouts"`
+	Quantiles           []float64     `yaml:"quantiles"`
+	QuantileTolerance   float64       `yaml:"quantile_tolerance"`
+	ValueBound          int           `yaml:"value_bound"`
+	Resources           []string      `yaml:"resources"`
+	Libraries           []string      `yaml:"libraries"`
+	ResourceLabels      bool          `yaml:"resource_labels"`
+	Points              int           `yaml:"points"`
+	PointInterval       time.Duration `yaml:"point_interval"`
+	Timestamps          bool          `yaml:"timestamps"`
+	InvalidMetrics      bool          `yaml:"invalid_metrics"`
+	DirtyNames          bool          `yaml:"dirty_names"`
+
+	printConfig bool     // print the configuration instead of running any stage
+	commands    []string // commands given after the flags
+}
+
+// defaultConfig returns a config populated with the default values of the package variables
+func defaultConfig() *config {
+	return &config{
+		CortexEndpoint:      cortexEndpoint,
+		QueryPath:           cortexQueryPath,
+		FakeCortex:          fakeCortexAddr,
+		InputPath:           inputPath,
+		OutputPath:          outputPath,
+		LatencyPath:         latencyPath,
+		Items:               item,
+		Endpoint:            endpoint,
+		FakeCollector:       fakeCollectorAddr,
+		HealthCheckEndpoint: healthCheckEndpoint,
+		ReadyTimeout:        readyTimeout,
+		RequestTimeout:      requestTimeout,
+		WaitTime:            waitTime,
+		IngestionTimeout:    ingestionTimeout,
+		PollInterval:        pollInterval,
+		QueryConcurrency:    queryConcurrency,
+		CollectorConfig:     collectorConfig,
+		Namespace:           namespace,
+		QueryRange:          queryRange,
+		QueryStep:           rangeStep,
+		Workers:             workers,
+		RequestRate:         requestRate,
+		DataPointRate:       dataPointRate,
+		Duration:            loadDuration,
+		Requests:            loadRequests,
+		ReportInterval:      reportInterval,
+		BatchSize:           batchSize,
+		BatchDataPoints:     batchDataPoints,
+		FlushInterval:       flushInterval,
+		AWSService:          awsService,
+		AWSRegion:           awsRegion,
+		Auth:                queryAuth,
+		BasicAuthUsername:   basicAuthUsername,
+		BasicAuthPassword:   basicAuthPassword,
+		BearerTokenFile:     bearerTokenFile,
+		TLSCAFile:           tlsCAFile,
+		TLSCertFile:         tlsCertFile,
+		TLSKeyFile:          tlsKeyFile,
+		TenantID:            tenantID,
+		Labels:              append([]string{}, labels...),
+		Bounds:              append([]float64{}, bounds...),
+		BucketLayouts:       append([]string{}, bucketLayouts...),
+		Quantiles:           append([]float64{}, quantiles...),
+		QuantileTolerance:   quantileTolerance,
+		ValueBound:          valueBound,
+		Resources:           append([]string{}, resources...),
+		Libraries:           append([]string{}, libraries...),
+		ResourceLabels:      resourceLabels,
+		Points:              seriesPoints,
+		PointInterval:       pointInterval,
+		Timestamps:          timestamps,
+		InvalidMetrics:      invalidMetrics,
+		DirtyNames:          dirtyNames,
+	}
+}
+
+// loadConfig resolves the configuration from the config file, the environment and args. Arguments after the flags are
+// the commands to run.
+func loadConfig(args []string) (*config, error) {
+	cfg := defaultConfig()
+
+	var configPath string
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", os.Getenv(envPrefix+"CONFIG"), "path to a YAML config file")
+	fs.BoolVar(&cfg.printConfig, "print-config", false, "print the effective configuration and exit")
+	cfg.registerFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: test [flags] [command...]\n\n")
+		fmt.Fprintf(fs.Output(), "Commands are run in order; run is the default:\n")
+		fmt.Fprintf(fs.Output(), "  generate\tgenerate metrics and write them to the input file\n")
+		fmt.Fprintf(fs.Output(), "  send\t\tsend the metrics in the input file to the Collector\n")
+		fmt.Fprintf(fs.Output(), "  query\t\tquery the metrics in the input file and write the results to the output file\n")
+		fmt.Fprintf(fs.Output(), "  verify\tcompare the input file with the output file\n")
+		fmt.Fprintf(fs.Output(), "  run\t\tgenerate, send, query and verify\n\n")
+		fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	// the first pass only finds the config file; flags are parsed again below so that they take precedence
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if configPath != "" {
+		if err := cfg.loadFile(configPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := loadEnv(fs); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg.commands = fs.Args()
+	if cfg.CollectorConfig != "" {
+		if err := cfg.loadCollectorConfig(cfg.CollectorConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// registerFlags binds a flag to each field of c
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.CortexEndpoint, "cortex-endpoint", c.CortexEndpoint, "base URL of Cortex")
+	fs.StringVar(&c.QueryPath, "query-path", c.QueryPath, "path of the instant query API, appended to the Cortex URL")
+	fs.StringVar(&c.FakeCortex, "fake-cortex", c.FakeCortex,
+		"listen address of an in-memory remote write backend to query instead of Cortex, e.g. localhost:9009")
+	fs.StringVar(&c.InputPath, "input-path", c.InputPath, "path of the generated data file")
+	fs.StringVar(&c.OutputPath, "output-path", c.OutputPath, "path of the query result file")
+	fs.StringVar(&c.LatencyPath, "latency-path", c.LatencyPath, "path of the time to visibility file, empty to skip it")
+	fs.IntVar(&c.Items, "items", c.Items, "total number of metrics to generate")
+	fs.StringVar(&c.Endpoint, "endpoint", c.Endpoint, "gRPC endpoint of the Collector OTLP receiver")
+	fs.StringVar(&c.FakeCollector, "fake-collector", c.FakeCollector,
+		"listen address of an in-process OTLP receiver to send to instead of the Collector, e.g. localhost:0")
+	fs.StringVar(&c.HealthCheckEndpoint, "health-check-endpoint", c.HealthCheckEndpoint,
+		"URL of the Collector health_check extension, empty to only check the gRPC endpoint")
+	fs.DurationVar(&c.ReadyTimeout, "ready-timeout", c.ReadyTimeout, "how long to wait for the Collector to become ready")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "timeout for each gRPC and HTTP request")
+	fs.DurationVar(&c.WaitTime, "wait-time", c.WaitTime, "wait time between two sends of a worker, ignored under load")
+	fs.DurationVar(&c.IngestionTimeout, "ingestion-timeout", c.IngestionTimeout,
+		"how long the querier waits for each metric to become visible after it was last sent")
+	fs.DurationVar(&c.PollInterval, "poll-interval", c.PollInterval, "wait time between two queries of a metric")
+	fs.IntVar(&c.QueryConcurrency, "query-concurrency", c.QueryConcurrency, "maximum number of queries to Cortex in flight")
+	fs.StringVar(&c.CollectorConfig, "collector-config", c.CollectorConfig,
+		"Collector config file to read the namespace and const labels of the remote write exporter from")
+	fs.StringVar(&c.Namespace, "namespace", c.Namespace, "prefix the exporter adds to every metric name")
+	fs.Var((*stringSlice)(&c.ConstLabels), "const-labels",
+		"comma-separated labels the exporter adds to every time series, each a space-separated name and value")
+	fs.BoolVar(&c.QueryRange, "query-range", c.QueryRange,
+		"query every metric with range queries and write every returned sample to the output file")
+	fs.StringVar(&c.QueryStart, "query-start", c.QueryStart,
+		"start of the range queries in RFC 3339 or unix seconds, empty for the first point of each metric")
+	fs.StringVar(&c.QueryEnd, "query-end", c.QueryEnd,
+		"end of the range queries in RFC 3339 or unix seconds, empty for a step after the time of each query")
+	fs.DurationVar(&c.QueryStep, "query-step", c.QueryStep, "resolution of the range queries")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "number of goroutines sending requests to the Collector")
+	fs.Float64Var(&c.RequestRate, "request-rate", c.RequestRate, "requests per second of all workers, 0 for unlimited")
+	fs.Float64Var(&c.DataPointRate, "data-point-rate", c.DataPointRate,
+		"data points per second of all workers, 0 for unlimited")
+	fs.DurationVar(&c.Duration, "duration", c.Duration,
+		"send the input file over and over for this long, 0 to send it once")
+	fs.IntVar(&c.Requests, "requests", c.Requests,
+		"send the input file over and over until this many requests were sent, 0 to send it once")
+	fs.DurationVar(&c.ReportInterval, "report-interval", c.ReportInterval,
+		"interval of the load counters logged while sending, 0 to only log the totals")
+	fs.IntVar(&c.BatchSize, "batch-size", c.BatchSize, "maximum number of metrics per request")
+	fs.IntVar(&c.BatchDataPoints, "batch-data-points", c.BatchDataPoints,
+		"maximum number of data points per request, 0 for unlimited")
+	fs.DurationVar(&c.FlushInterval, "flush-interval", c.FlushInterval,
+		"maximum time a batch waits for more metrics before it is sent, 0 to only send full batches")
+	fs.StringVar(&c.AWSService, "aws-service", c.AWSService, "AWS service name used for sig v4 signing")
+	fs.StringVar(&c.AWSRegion, "aws-region", c.AWSRegion, "AWS region used for sig v4 signing")
+	fs.StringVar(&c.Auth, "auth", c.Auth, "authentication of the queries: "+strings.Join(authSchemes, ", "))
+	fs.StringVar(&c.BasicAuthUsername, "basic-auth-username", c.BasicAuthUsername, "username of the basic auth")
+	fs.StringVar(&c.BasicAuthPassword, "basic-auth-password", c.BasicAuthPassword, "password of the basic auth")
+	fs.StringVar(&c.BearerTokenFile, "bearer-token-file", c.BearerTokenFile,
+		"file holding the token of the bearer auth, read for every query")
+	fs.StringVar(&c.TLSCAFile, "tls-ca-file", c.TLSCAFile,
+		"CA certificate to verify the query endpoint with, the system roots if empty")
+	fs.StringVar(&c.TLSCertFile, "tls-cert-file", c.TLSCertFile,
+		"client certificate presented to the query endpoint, required by the mtls auth")
+	fs.StringVar(&c.TLSKeyFile, "tls-key-file", c.TLSKeyFile, "key of the client certificate")
+	fs.StringVar(&c.TenantID, "tenant-id", c.TenantID,
+		"tenant sent in the "+tenantHeader+" header of every query, for multi-tenant Cortex; not sent if empty")
+	fs.Var((*stringSlice)(&c.Labels), "labels", "comma-separated label sets, each a space-separated name and value")
+	fs.Var((*float64Slice)(&c.Bounds), "bounds", "comma-separated histogram bounds")
+	fs.Var((*stringSlice)(&c.BucketLayouts), "bucket-layouts",
+		"comma-separated histogram bucket layouts taken in turn, e.g. \"linear 0 10 5,exponential 1 2 8,custom 1 5,none\"")
+	fs.Var((*float64Slice)(&c.Quantiles), "quantiles", "comma-separated summary quantiles, in [0, 1]")
+	fs.Float64Var(&c.QuantileTolerance, "quantile-tolerance", c.QuantileTolerance,
+		"relative tolerance of the summary quantile values, e.g. 0.01 for 1%")
+	fs.IntVar(&c.ValueBound, "value-bound", c.ValueBound, "generated metric values are in [0, value-bound)")
+	fs.Var((*stringSlice)(&c.Resources), "resources",
+		"comma-separated resources sending the generated metrics, each a space-separated list of name=value attributes")
+	fs.Var((*stringSlice)(&c.Libraries), "libraries",
+		"comma-separated instrumentation libraries recording the generated metrics, each a name and an optional version")
+	fs.BoolVar(&c.ResourceLabels, "resource-labels", c.ResourceLabels,
+		"expect the resource attributes of each metric among the labels of its time series")
+	fs.IntVar(&c.Points, "points", c.Points, "number of points of each generated time series")
+	fs.DurationVar(&c.PointInterval, "point-interval", c.PointInterval, "time between two points of a time series")
+	fs.BoolVar(&c.Timestamps, "timestamps", c.Timestamps,
+		"write the timestamp of each generated point to the input file, instead of stamping it when it is sent")
+	fs.BoolVar(&c.InvalidMetrics, "invalid-metrics", c.InvalidMetrics,
+		"generate metrics of invalid OTLP types and temporalities as well, and expect the exporter to drop them")
+	fs.BoolVar(&c.DirtyNames, "dirty-names", c.DirtyNames,
+		"generate metric and label names with characters illegal in Prometheus, and expect the exporter to sanitize them")
+}
+
+// loadFile overrides the fields of c that are set in the YAML file at path
+func (c *config) loadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// exporterConfig is the part of the config of a Cortex or Prometheus remote write exporter that changes the time series
+// it writes
+type exporterConfig struct {
+	Namespace      string            `yaml:"namespace"`
+	ConstLabels    map[string]string `yaml:"const_labels"`
+	ExternalLabels map[string]string `yaml:"external_labels"`
+}
+
+// loadCollectorConfig sets the namespace and const labels of c to those of the remote write exporter in the Collector
+// config file at path, unless they are set already. The exporter must be the only one of type cortex or
+// prometheusremotewrite; other exporters and settings are ignored.
+func (c *config) loadCollectorConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var collector struct {
+		Exporters map[string]*exporterConfig `yaml:"exporters"`
+	}
+	if err := yaml.Unmarshal(content, &collector); err != nil {
+		return fmt.Errorf("invalid Collector config file %s: %v", path, err)
+	}
+
+	var exporter *exporterConfig
+	for name, e := range collector.Exporters {
+		switch strings.SplitN(name, "/", 2)[0] {
+		case "cortex", "prometheusremotewrite":
+			if exporter != nil {
+				return fmt.Errorf("more than one remote write exporter in Collector config file %s", path)
+			}
+			exporter = e
+		}
+	}
+	if exporter == nil {
+		return fmt.Errorf("no remote write exporter in Collector config file %s", path)
+	}
+
+	if c.Namespace == "" {
+		c.Namespace = exporter.Namespace
+	}
+	if len(c.ConstLabels) == 0 {
+		for _, labels := range []map[string]string{exporter.ConstLabels, exporter.ExternalLabels} {
+			pairs := labelPairs(labels)
+			for i := 0; i < len(pairs); i += 2 {
+				c.ConstLabels = append(c.ConstLabels, pairs[i]+space+pairs[i+1])
+			}
+		}
+	}
+	return nil
+}
+
+// loadEnv sets each flag of fs from its environment variable, if the variable is set
+func loadEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// validate checks that every option has a usable value
+func (c *config) validate() error {
+	var errs []string
+	if _, err := url.ParseRequestURI(c.CortexEndpoint + c.QueryPath); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid Cortex query URL %q", c.CortexEndpoint+c.QueryPath))
+	}
+	if c.InputPath == "" {
+		errs = append(errs, "input_path must not be empty")
+	}
+	if c.OutputPath == "" {
+		errs = append(errs, "output_path must not be empty")
+	}
+	if c.Items <= 0 {
+		errs = append(errs, "items must be positive")
+	}
+	if c.Endpoint == "" {
+		errs = append(errs, "endpoint must not be empty")
+	}
+	if c.HealthCheckEndpoint != "" {
+		if _, err := url.ParseRequestURI(c.HealthCheckEndpoint); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid health check URL %q", c.HealthCheckEndpoint))
+		}
+	}
+	if c.ReadyTimeout <= 0 {
+		errs = append(errs, "ready_timeout must be positive")
+	}
+	if c.RequestTimeout <= 0 {
+		errs = append(errs, "request_timeout must be positive")
+	}
+	if c.WaitTime < 0 {
+		errs = append(errs, "wait_time must not be negative")
+	}
+	if c.IngestionTimeout < 0 {
+		errs = append(errs, "ingestion_timeout must not be negative")
+	}
+	if c.PollInterval <= 0 {
+		errs = append(errs, "poll_interval must be positive")
+	}
+	if c.QueryConcurrency <= 0 {
+		errs = append(errs, "query_concurrency must be positive")
+	}
+	start, startErr := parseQueryTime(c.QueryStart)
+	if startErr != nil {
+		errs = append(errs, fmt.Sprintf("invalid query_start %q", c.QueryStart))
+	}
+	end, endErr := parseQueryTime(c.QueryEnd)
+	if endErr != nil {
+		errs = append(errs, fmt.Sprintf("invalid query_end %q", c.QueryEnd))
+	}
+	if startErr == nil && endErr == nil && !start.IsZero() && !end.IsZero() && end.Before(start) {
+		errs = append(errs, "query_end must not be before query_start")
+	}
+	if c.QueryStep <= 0 {
+		errs = append(errs, "query_step must be positive")
+	}
+	if c.Workers <= 0 {
+		errs = append(errs, "workers must be positive")
+	}
+	if c.RequestRate < 0 {
+		errs = append(errs, "request_rate must not be negative")
+	}
+	if c.DataPointRate < 0 {
+		errs = append(errs, "data_point_rate must not be negative")
+	}
+	if c.Duration < 0 {
+		errs = append(errs, "duration must not be negative")
+	}
+	if c.Requests < 0 {
+		errs = append(errs, "requests must not be negative")
+	}
+	if c.ReportInterval < 0 {
+		errs = append(errs, "report_interval must not be negative")
+	}
+	if c.BatchSize <= 0 {
+		errs = append(errs, "batch_size must be positive")
+	}
+	if c.BatchDataPoints < 0 {
+		errs = append(errs, "batch_data_points must not be negative")
+	}
+	if c.FlushInterval < 0 {
+		errs = append(errs, "flush_interval must not be negative")
+	}
+	switch c.Auth {
+	case noAuth, sigv4Auth:
+	case basicAuth:
+		if c.BasicAuthUsername == "" {
+			errs = append(errs, "basic_auth_username must be set for the basic auth")
+		}
+	case bearerAuth:
+		if c.BearerTokenFile == "" {
+			errs = append(errs, "bearer_token_file must be set for the bearer auth")
+		}
+	case mtlsAuth:
+		if c.TLSCertFile == "" {
+			errs = append(errs, "tls_cert_file and tls_key_file must be set for the mtls auth")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("auth must be one of %s", strings.Join(authSchemes, ", ")))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, "tls_cert_file and tls_key_file must be set together")
+	}
+	if len(c.Labels) == 0 {
+		errs = append(errs, "labels must not be empty")
+	}
+	for _, l := range c.Labels {
+		if len(strings.Fields(l)) != 2 {
+			errs = append(errs, fmt.Sprintf("label %q must be a name and a value separated by a space", l))
+		}
+	}
+	for _, l := range c.ConstLabels {
+		if len(strings.Fields(l)) != 2 {
+			errs = append(errs, fmt.Sprintf("const label %q must be a name and a value separated by a space", l))
+		}
+	}
+	if len(c.Bounds) == 0 {
+		errs = append(errs, "bounds must not be empty")
+	}
+	for i := 1; i < len(c.Bounds); i++ {
+		if c.Bounds[i] <= c.Bounds[i-1] {
+			errs = append(errs, "bounds must be in increasing order")
+			break
+		}
+	}
+	for _, layout := range c.BucketLayouts {
+		if _, err := parseBucketLayout(layout); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(c.Quantiles) == 0 {
+		errs = append(errs, "quantiles must not be empty")
+	}
+	for i, q := range c.Quantiles {
+		if q < 0 || q > 1 {
+			errs = append(errs, fmt.Sprintf("quantile %v must be in [0, 1]", q))
+		}
+		if i > 0 && q <= c.Quantiles[i-1] {
+			errs = append(errs, "quantiles must be in increasing order")
+			break
+		}
+	}
+	if c.QuantileTolerance < 0 {
+		errs = append(errs, "quantile_tolerance must not be negative")
+	}
+	if c.ValueBound <= 0 {
+		errs = append(errs, "value_bound must be positive")
+	}
+	for _, r := range c.Resources {
+		if _, err := parseResource(r); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if c.Points <= 0 {
+		errs = append(errs, "points must be positive")
+	}
+	if c.PointInterval <= 0 {
+		errs = append(errs, "point_interval must be positive")
+	}
+	if c.QueryRange && c.Points > 1 && c.QueryStep >= c.PointInterval {
+		// a coarser step would skip points, which the verifier reports as dropped; a single point cannot be skipped
+		errs = append(errs, "query_step must be shorter than point_interval with query_range")
+	}
+	for _, l := range c.Libraries {
+		if n := len(strings.Fields(l)); n < 1 || n > 2 {
+			errs = append(errs, fmt.Sprintf("library %q must be a name and an optional version separated by a space", l))
+		}
+	}
+	for _, cmd := range c.commands {
+		if _, ok := stages[cmd]; !ok && cmd != "run" {
+			errs = append(errs, fmt.Sprintf("unknown command %q", cmd))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n\t" + strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// stages returns the names of the stages to run, in order, with the run command expanded
+func (c *config) stages() []string {
+	if len(c.commands) == 0 {
+		return runStages
+	}
+	var result []string
+	for _, cmd := range c.commands {
+		if cmd == "run" {
+			result = append(result, runStages...)
+			continue
+		}
+		result = append(result, cmd)
+	}
+	return result
+}
+
+// apply copies the configuration to the package variables used by the test stages
+func (c *config) apply() {
+	cortexEndpoint = c.CortexEndpoint
+	cortexQueryPath = c.QueryPath
+	queryPath = c.CortexEndpoint + c.QueryPath
+	fakeCortexAddr = c.FakeCortex
+	inputPath = c.InputPath
+	outputPath = c.OutputPath
+	latencyPath = c.LatencyPath
+	item = c.Items
+	endpoint = c.Endpoint
+	fakeCollectorAddr = c.FakeCollector
+	healthCheckEndpoint = c.HealthCheckEndpoint
+	readyTimeout = c.ReadyTimeout
+	requestTimeout = c.RequestTimeout
+	waitTime = c.WaitTime
+	ingestionTimeout = c.IngestionTimeout
+	pollInterval = c.PollInterval
+	queryConcurrency = c.QueryConcurrency
+	collectorConfig = c.CollectorConfig
+	namespace = c.Namespace
+	constLabels = make(map[string]string, len(c.ConstLabels))
+	for _, l := range c.ConstLabels {
+		pair := strings.Fields(l)
+		constLabels[pair[0]] = pair[1]
+	}
+	queryRange = c.QueryRange
+	rangeStart, _ = parseQueryTime(c.QueryStart)
+	rangeEnd, _ = parseQueryTime(c.QueryEnd)
+	rangeStep = c.QueryStep
+	workers = c.Workers
+	requestRate = c.RequestRate
+	dataPointRate = c.DataPointRate
+	loadDuration = c.Duration
+	loadRequests = c.Requests
+	reportInterval = c.ReportInterval
+	batchSize = c.BatchSize
+	batchDataPoints = c.BatchDataPoints
+	flushInterval = c.FlushInterval
+	awsService = c.AWSService
+	awsRegion = c.AWSRegion
+	queryAuth = c.Auth
+	basicAuthUsername = c.BasicAuthUsername
+	basicAuthPassword = c.BasicAuthPassword
+	bearerTokenFile = c.BearerTokenFile
+	tlsCAFile = c.TLSCAFile
+	tlsCertFile = c.TLSCertFile
+	tlsKeyFile = c.TLSKeyFile
+	tenantID = c.TenantID
+	labels = c.Labels
+	bounds = c.Bounds
+	bucketLayouts = c.BucketLayouts
+	quantiles = c.Quantiles
+	quantileTolerance = c.QuantileTolerance
+	valueBound = c.ValueBound
+	resources = c.Resources
+	libraries = c.Libraries
+	resourceLabels = c.ResourceLabels
+	seriesPoints = c.Points
+	pointInterval = c.PointInterval
+	timestamps = c.Timestamps
+	invalidMetrics = c.InvalidMetrics
+	dirtyNames = c.DirtyNames
+}
+
+// print writes the configuration to stdout in the config file format, with the basic auth password redacted
+func (c *config) print() error {
+	redacted := *c
+	if redacted.BasicAuthPassword != "" {
+		redacted.BasicAuthPassword = "<secret>"
+	}
+	out, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// parseQueryTime parses a time in RFC 3339 or unix seconds, like the query API. An empty string is the zero time.
+func parseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return parseTime(s)
+}
+
+// stringSlice is a flag.Value of comma-separated strings
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, delimeter)
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = nil
+	// an empty value clears the list
+	if value == "" {
+		return nil
+	}
+	for _, str := range strings.Split(value, delimeter) {
+		*s = append(*s, strings.TrimSpace(str))
+	}
+	return nil
+}
+
+// float64Slice is a flag.Value of comma-separated numbers
+type float64Slice []float64
+
+func (s *float64Slice) String() string {
+	if s == nil {
+		return ""
+	}
+	strs := make([]string, len(*s))
+	for i, f := range *s {
+		strs[i] = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strings.Join(strs, delimeter)
+}
+
+func (s *float64Slice) Set(value string) error {
+	*s = nil
+	// an empty value clears the list
+	if value == "" {
+		return nil
+	}
+	for _, str := range strings.Split(value, delimeter) {
+		f, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return err
+		}
+		*s = append(*s, f)
+	}
+	return nil
+}
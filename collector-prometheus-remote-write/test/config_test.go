@@ -0,0 +1,214 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setEnv replaces every CORTEX_TEST_ variable of the environment with vars, and returns a function that restores them
+func setEnv(vars map[string]string) func() {
+	saved := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envPrefix) {
+			pair := strings.SplitN(kv, "=", 2)
+			saved[pair[0]] = pair[1]
+			os.Unsetenv(pair[0])
+		}
+	}
+	for name, value := range vars {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range vars {
+			os.Unsetenv(name)
+		}
+		for name, value := range saved {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+func Test_loadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := tempFile(t, dir, "config.yaml", "items: 5\nworkers: 2\nbatch_size: 3\nbounds: [1, 2]\n")
+	defer setEnv(map[string]string{
+		"CORTEX_TEST_CONFIG":     configFile,
+		"CORTEX_TEST_WORKERS":    "4",
+		"CORTEX_TEST_BATCH_SIZE": "6",
+		"CORTEX_TEST_QUANTILES":  "0.25, 0.75",
+	})()
+
+	cfg, err := loadConfig([]string{"-batch-size", "7", "send", "query"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// defaults < config file < environment < flags
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"default", cfg.QueryConcurrency, queryConcurrency},
+		{"config_file", cfg.Items, 5},
+		{"config_file_list", cfg.Bounds, []float64{1, 2}},
+		{"environment", cfg.Workers, 4},
+		{"environment_list", cfg.Quantiles, []float64{0.25, 0.75}},
+		{"flag", cfg.BatchSize, 7},
+		{"commands", cfg.commands, []string{"send", "query"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_loadConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	unknownField := tempFile(t, dir, "unknown.yaml", "itemz: 5\n")
+	bounds := tempFile(t, dir, "bounds.yaml", "bounds: [1, 2]\n")
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{"unknown_field", nil, []string{"-config", unknownField}, "invalid config file " + unknownField},
+		{"missing_file", nil, []string{"-config", dir + "/missing.yaml"}, "no such file"},
+		{"invalid_env", map[string]string{"CORTEX_TEST_ITEMS": "many"}, nil,
+			`invalid value "many" for CORTEX_TEST_ITEMS`},
+		{"env_clears_list", map[string]string{"CORTEX_TEST_BOUNDS": ""}, []string{"-config", bounds},
+			"bounds must not be empty"},
+		{"flag_over_env", map[string]string{"CORTEX_TEST_ITEMS": "-1"}, []string{"-items", "0"}, "items must be positive"},
+		{"unknown_command", nil, []string{"generate", "check"}, `unknown command "check"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setEnv(tt.env)()
+			_, err := loadConfig(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(c *config)
+		wantErr []string
+	}{
+		{"defaults", func(c *config) {}, nil},
+		{"items", func(c *config) { c.Items = 0 }, []string{"items must be positive"}},
+		{"query_url", func(c *config) { c.CortexEndpoint, c.QueryPath = "", "" }, []string{"invalid Cortex query URL"}},
+		{"several", func(c *config) { c.Workers, c.BatchSize = 0, 0 },
+			[]string{"workers must be positive", "batch_size must be positive"}},
+		{"query_end_before_start", func(c *config) { c.QueryStart, c.QueryEnd = "20", "10" },
+			[]string{"query_end must not be before query_start"}},
+		{"query_step", func(c *config) {
+			c.QueryRange, c.Points, c.QueryStep, c.PointInterval = true, 2, 10*time.Second, 10*time.Second
+		}, []string{"query_step must be shorter than point_interval"}},
+		{"query_step_single_point", func(c *config) {
+			c.QueryRange, c.Points, c.QueryStep, c.PointInterval = true, 1, 10*time.Second, 10*time.Second
+		}, nil},
+		{"query_step_without_query_range", func(c *config) {
+			c.Points, c.QueryStep, c.PointInterval = 2, 10*time.Second, 10*time.Second
+		}, nil},
+		{"basic_auth", func(c *config) { c.Auth = basicAuth }, []string{"basic_auth_username must be set"}},
+		{"unknown_auth", func(c *config) { c.Auth = "kerberos" }, []string{"auth must be one of"}},
+		{"tls_key", func(c *config) { c.TLSCertFile = "client.crt" }, []string{"must be set together"}},
+		{"labels", func(c *config) { c.Labels = []string{"label1"} }, []string{`label "label1" must be a name and a value`}},
+		{"bounds", func(c *config) { c.Bounds = []float64{2, 1} }, []string{"bounds must be in increasing order"}},
+		{"quantiles", func(c *config) { c.Quantiles = []float64{0.5, 2} }, []string{"quantile 2 must be in [0, 1]"}},
+		{"library", func(c *config) { c.Libraries = []string{"a b c"} }, []string{`library "a b c"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.set(c)
+			err := c.validate()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error, want %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("got %v, want an error containing %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_stages(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []string
+		want     []string
+	}{
+		{"default", nil, runStages},
+		{"chained", []string{"send", "query", "verify"}, []string{"send", "query", "verify"}},
+		{"run_expanded", []string{"run", "verify"}, []string{"generate", "send", "query", "verify", "verify"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config{commands: tt.commands}
+			if got := c.stages(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sliceFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		strings []string
+		floats  []float64
+		wantErr bool
+	}{
+		{"empty", "", nil, nil, false},
+		{"single", "1", []string{"1"}, []float64{1}, false},
+		{"spaces", "0.5, 1 ,2", []string{"0.5", "1", "2"}, []float64{0.5, 1, 2}, false},
+		{"not_a_number", "1,a", []string{"1", "a"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a set value replaces the previous list
+			strs := stringSlice{"previous"}
+			if err := strs.Set(tt.value); err != nil || !reflect.DeepEqual([]string(strs), tt.strings) {
+				t.Errorf("stringSlice: got %v, %v, want %v", strs, err, tt.strings)
+			}
+			floats := float64Slice{-1}
+			err := floats.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("float64Slice: got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual([]float64(floats), tt.floats) {
+				t.Errorf("float64Slice: got %v, want %v", floats, tt.floats)
+			}
+		})
+	}
+}
@@ -2,75 +2,271 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"math/rand"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// generateData writes metrics in the following format to a text file:
-// 		 name, type, label1 labelvalue1 , value1 value2 value3 value4 value5
-// gauge and counter has only one value
-func generateData() {
-	f, err := os.Create(inputPath)
+// generateData writes a random metric to each line of the input file, with each valid combination of OTLP type and
+// temporality in turn. See datafile.go for the format.
+func generateData() error {
+	f, err := createDataFile(inputPath)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	defer f.Close()
 
+	w, err := newDataWriter(f)
+	if err != nil {
+		return err
+	}
+	combinations := generatedCombinations()
+	cases := len(combinations)
+	if invalidMetrics {
+		cases++ // a metric without a descriptor
+	}
+	layouts, err := histogramBounds()
+	if err != nil {
+		return err
+	}
+	histograms := 0
+	// the points of every time series start now, so that the sender sends each of them after its timestamp
+	start := time.Now()
 	for i := 0; i < item; i++ {
-
-		mName := metric + strconv.Itoa(i)
-		mType := types[rand.Intn(len(types))]
+		mName := metric + strconv.Itoa(i) + randomSuffix
 		labelSize := rand.Intn(len(labels)) + 1
-		b := &strings.Builder{}
-		writeNameTypeLabel(mName, mType, labelSize, b)
+		r := &record{
+			Name:   mName,
+			Labels: generateLabels(labelSize),
+		}
+		if dirtyNames {
+			r.Name, r.Labels = dirtyName(r.Name, i), dirtyLabels(r.Labels, i)
+		}
+		// every combination is generated in turn, followed by a metric without a descriptor if invalidMetrics is set
+		if k := i % cases; k < len(combinations) {
+			setCombination(r, combinations[k])
+		} else {
+			r.Type, r.ValueType, r.NoDescriptor = gauge, int64Value, true
+		}
+		if len(resources) > 0 {
+			// validated with the configuration
+			r.Resource, _ = parseResource(resources[rand.Intn(len(resources))])
+		}
+		if len(libraries) > 0 {
+			library := strings.Fields(libraries[rand.Intn(len(libraries))])
+			r.Library = library[0]
+			if len(library) > 1 {
+				r.LibraryVersion = library[1]
+			}
+		}
+		if r.Type == histogram {
+			r.Bounds = layouts[histograms%len(layouts)]
+			histograms++
+		}
+		if seriesPoints > 1 {
+			r.Points = generatePoints(r.Type, r.ValueType, len(r.Bounds), seriesPoints)
+			if timestamps {
+				for j := range r.Points {
+					r.Points[j].Timestamp = uint64(start.Add(time.Duration(j) * pointInterval).UnixNano())
+				}
+			}
+		} else {
+			p := generatePoint(r.Type, r.ValueType, len(r.Bounds))
+			r.Value, r.Sum, r.Count, r.Buckets, r.Quantiles = p.Value, p.Sum, p.Count, p.Buckets, p.Quantiles
+			if timestamps {
+				r.Timestamp = uint64(start.UnixNano())
+			}
+		}
+		if err := w.write(r); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// generatedCombinations returns the valid OTLP types and temporalities of the metric types to generate, followed by
+// the invalid ones if invalidMetrics is set
+func generatedCombinations() []combination {
+	combinations := validCombinations
+	if invalidMetrics {
+		combinations = append(append([]combination{}, validCombinations...), invalidCombinations...)
+	}
+	var result []combination
+	for _, c := range combinations {
+		r := &record{}
+		setCombination(r, c)
+		for _, t := range types {
+			if r.Type == t {
+				result = append(result, c)
+			}
+		}
+	}
+	return result
+}
+
+// histogramBounds returns the bounds of each of the bucketLayouts, or only bounds if there are none
+func histogramBounds() ([][]float64, error) {
+	if len(bucketLayouts) == 0 {
+		return [][]float64{bounds}, nil
+	}
+	result := make([][]float64, len(bucketLayouts))
+	for i, layout := range bucketLayouts {
+		b, err := parseBucketLayout(layout)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = b
+	}
+	return result, nil
+}
+
+// generatePoint returns a random point of type mType, with a fractional value if valueType is double. A histogram has
+// a bucket for each of its boundCount bounds and the overflow bucket, for values above the last bound.
+func generatePoint(mType, valueType string, boundCount int) point {
+	var p point
+	switch mType {
+	case gauge, counter:
+		v := float64(rand.Intn(valueBound))
+		if valueType == doubleValue {
+			v += rand.Float64()
+		}
+		p.Value = &v
+	case histogram:
+		p.Buckets = make([]uint64, boundCount+1)
+		for i := range p.Buckets {
+			n := uint64(rand.Intn(valueBound))
+			p.Buckets[i] = n // individual bucket
+			p.Count += n
+		}
+		p.Sum = float64(rand.Intn(valueBound))
+	case summary:
+		p = summaryPoint(observe(nil, 1+rand.Intn(valueBound)))
+	}
+	return p
+}
+
+// observe returns the sorted sample with n more random values in [0, valueBound), most of them small like latencies
+func observe(sample []float64, n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = rand.Float64() * rand.Float64() * float64(valueBound)
+	}
+	sort.Float64s(values)
+	result := make([]float64, 0, len(sample)+n)
+	i, j := 0, 0
+	for i < len(sample) && j < len(values) {
+		if sample[i] <= values[j] {
+			result = append(result, sample[i])
+			i++
+		} else {
+			result = append(result, values[j])
+			j++
+		}
+	}
+	result = append(result, sample[i:]...)
+	return append(result, values[j:]...)
+}
+
+// summaryPoint returns the point of a summary that observed the values of the sorted sample, with their sum, count and
+// each of the quantiles
+func summaryPoint(sample []float64) point {
+	p := point{Count: uint64(len(sample))}
+	for _, v := range sample {
+		p.Sum += v
+	}
+	for _, q := range quantiles {
+		p.Quantiles = append(p.Quantiles, quantile{Quantile: q, Value: sampleQuantile(sample, q)})
+	}
+	return p
+}
+
+// generatePoints returns n points of a time series of type mType: counters increase, gauges take a random walk, the
+// buckets, sum and count of histograms accumulate, and summaries observe more values
+func generatePoints(mType, valueType string, boundCount, n int) []point {
+	step := valueBound/10 + 1
+	points := make([]point, n)
+	var sample []float64 // the values a summary observed up to the current point
+	if mType == summary {
+		sample = observe(nil, 1+rand.Intn(valueBound))
+		points[0] = summaryPoint(sample)
+	} else {
+		points[0] = generatePoint(mType, valueType, boundCount)
+	}
+	for i := 1; i < n; i++ {
+		prev, p := points[i-1], &points[i]
 		switch mType {
-		case gauge, counter:
-			b.WriteString(strconv.Itoa(rand.Intn(valueBound)))
-		case histogram:
-			count := 0
-			buckets := make([]int, 3, 3)
-			for i := range bounds {
-				n := rand.Intn(valueBound)
-				buckets[i] = n
-				count += n
+		case counter:
+			v := *prev.Value + float64(rand.Intn(step))
+			if valueType == doubleValue {
+				v += rand.Float64()
 			}
-			b.WriteString(strconv.Itoa(rand.Intn(valueBound))) // sum
-			b.WriteString(space)
-			b.WriteString(strconv.Itoa(count)) // count
-			b.WriteString(space)
-			for _, val := range buckets {
-				b.WriteString(strconv.Itoa(val)) // individual bucket
-				b.WriteString(space)
+			p.Value = &v
+		case gauge:
+			v := *prev.Value + float64(rand.Intn(2*step+1)-step)
+			if valueType == doubleValue {
+				v += rand.Float64() - 0.5
 			}
-		case summary:
-			b.WriteString(strconv.Itoa(rand.Intn(valueBound))) // sum
-			b.WriteString(space)
-			b.WriteString(strconv.Itoa(rand.Intn(valueBound))) // count
-			b.WriteString(space)
-			for range bounds {
-				b.WriteString(fmt.Sprintf("%f", rand.Float64())) // individual quantile
-				b.WriteString(space)
+			p.Value = &v
+		case histogram:
+			p.Buckets = make([]uint64, len(prev.Buckets))
+			for j, count := range prev.Buckets {
+				p.Buckets[j] = count + uint64(rand.Intn(step))
+				p.Count += p.Buckets[j]
 			}
+			p.Sum = prev.Sum + float64(rand.Intn(step))
+		case summary:
+			sample = observe(sample, rand.Intn(step))
+			*p = summaryPoint(sample)
 		}
-		b.WriteString("\n")
-		f.WriteString(b.String())
 	}
+	return points
 }
 
-// writeNameTypeLabel prints the delimited metric name, metric type, and constant label values to the StringBuilder b
-func writeNameTypeLabel(mName, mType string, labelSize int, b *strings.Builder) {
-	b.WriteString(mName)
-	b.WriteString(randomSuffix)
-	b.WriteString(delimeter)
-	b.WriteString(mType)
-	b.WriteString(delimeter)
+// generateLabels returns the first labelSize label sets of the labels option
+func generateLabels(labelSize int) map[string]string {
+	set := make(map[string]string, labelSize)
 	for i := 0; i < labelSize; i++ {
-		b.WriteString(labels[i])
-		b.WriteString(space)
+		pair := strings.Fields(labels[i])
+		set[pair[0]] = pair[1]
+	}
+	return set
+}
+
+// dirtyName returns name with one of the dirtyChars, picked by i, at the start, in the middle, or at the end after a
+// leading digit, so that the sanitized names of all i start with "key_" or a letter and stay distinct
+func dirtyName(name string, i int) string {
+	c := dirtyChars[i%len(dirtyChars)]
+	switch i % 3 {
+	case 0:
+		return c + name
+	case 1:
+		return strconv.Itoa(i%10) + name + c
+	default:
+		return name[:len(name)/2] + c + name[len(name)/2:]
+	}
+}
+
+// dirtyLabels returns labels with dirty names, each picked by i and the position of the label in name order
+func dirtyLabels(labels map[string]string, i int) map[string]string {
+	result := make(map[string]string, len(labels))
+	pairs := labelPairs(labels)
+	for j := 0; j < len(pairs); j += 2 {
+		result[dirtyName(pairs[j], i+j/2)] = pairs[j+1]
+	}
+	return result
+}
+
+// parseResource parses the space-separated name=value attributes of a resource
+func parseResource(str string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Fields(str) {
+		i := strings.Index(attr, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("resource attribute %q must be a name and a value separated by =", attr)
+		}
+		attrs[attr[:i]] = attr[i+1:]
 	}
-	b.WriteString(delimeter)
+	return attrs, nil
 }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	dataFormat        = "cortex-exporter-test-data"
+	dataFormatVersion = 1
+)
+
+// dataHeader is the first line of a data file and identifies its format
+type dataHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// record is a single metric of a data file. The input file has a record for each generated metric, and the output
+// file has a record for each queried metric.
+type record struct {
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`                    // gauge, counter, histogram or summary
+	ValueType    string            `json:"value_type,omitempty"`    // gauge and counter, int64 if empty or double
+	Temporality  string            `json:"temporality,omitempty"`   // cumulative if empty, delta or instantaneous
+	OTLPType     string            `json:"otlp_type,omitempty"`     // sent in the place of the type, e.g. invalid_type
+	NoDescriptor bool              `json:"no_descriptor,omitempty"` // sent without a descriptor, so without a name
+	Description  string            `json:"description,omitempty"`
+	Unit         string            `json:"unit,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Timestamp    uint64            `json:"timestamp,omitempty"` // unix nanoseconds, the time of sending if zero
+
+	Resource       map[string]string `json:"resource,omitempty"` // attributes of the resource that sends the metric
+	Library        string            `json:"library,omitempty"`  // name of the instrumentation library
+	LibraryVersion string            `json:"library_version,omitempty"`
+
+	Value *float64 `json:"value,omitempty"` // gauge and counter
+
+	Sum       float64    `json:"sum,omitempty"` // histogram and summary
+	Count     uint64     `json:"count,omitempty"`
+	Bounds    []float64  `json:"bounds,omitempty"`  // histogram
+	Buckets   []uint64   `json:"buckets,omitempty"` // histogram, the count of each bucket, cumulative in output files
+	Quantiles []quantile `json:"quantiles,omitempty"`
+
+	// Points are the data points of a time series, in the place of the single value above
+	Points []point `json:"points,omitempty"`
+
+	line int // line number in the file the record was read from
+}
+
+// point is a data point of a time series. Histogram buckets and summary quantiles are cumulative like in OTLP, so each
+// point holds the totals up to its timestamp.
+type point struct {
+	Timestamp uint64     `json:"timestamp,omitempty"` // unix nanoseconds, scheduled by the sender if zero
+	Value     *float64   `json:"value,omitempty"`
+	Sum       float64    `json:"sum,omitempty"`
+	Count     uint64     `json:"count,omitempty"`
+	Buckets   []uint64   `json:"buckets,omitempty"`
+	Quantiles []quantile `json:"quantiles,omitempty"`
+}
+
+// quantile is a single quantile of a summary
+type quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// key identifies a time series by its metric name and sorted label set
+func (r *record) key() string {
+	return r.Name + signatureSep + labelMapSignature(r.Labels)
+}
+
+// points returns the data points of r, which is a single point unless r is a time series
+func (r *record) points() []point {
+	if len(r.Points) > 0 {
+		return r.Points
+	}
+	return []point{{r.Timestamp, r.Value, r.Sum, r.Count, r.Buckets, r.Quantiles}}
+}
+
+// valid reports whether r has a descriptor of a valid OTLP type and temporality, which the exporter writes to Cortex
+func (r *record) valid() bool {
+	c, _ := metricCombination(r) // checked when r was read
+	return !r.NoDescriptor && validCombination(c)
+}
+
+// timestamped reports whether every point of r has a timestamp
+func (r *record) timestamped() bool {
+	for _, p := range r.points() {
+		if p.Timestamp == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// at returns a copy of r with only its ith point
+func (r *record) at(i int) *record {
+	p := r.points()[i]
+	single := *r
+	single.Points = nil
+	single.Timestamp, single.Value, single.Sum, single.Count = p.Timestamp, p.Value, p.Sum, p.Count
+	single.Buckets, single.Quantiles = p.Buckets, p.Quantiles
+	return &single
+}
+
+// labelMapSignature returns a string that uniquely identifies a label set
+func labelMapSignature(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+signatureSep+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, signatureSep)
+}
+
+// dataWriter writes records to a data file, one JSON object per line
+type dataWriter struct {
+	enc *json.Encoder
+}
+
+// createDataFile creates the data file path, and the directory it is in if it does not exist, like the test directory
+// of the default input and output paths
+func createDataFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// newDataWriter writes the header of the data file to w
+func newDataWriter(w io.Writer) (*dataWriter, error) {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&dataHeader{Format: dataFormat, Version: dataFormatVersion}); err != nil {
+		return nil, err
+	}
+	return &dataWriter{enc}, nil
+}
+
+func (dw *dataWriter) write(r *record) error {
+	return dw.enc.Encode(r)
+}
+
+// readDataFile reads every record of a data file. Errors in the file are returned as a *parseError with the line
+// number. Files without a header are read in the legacy text format:
+//
+//	name, type, label1 labelvalue1 , value1 value2 value3 value4 value5
+func readDataFile(path string) ([]*record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []*record
+	var parse func(string) (*record, error)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if parse == nil {
+			if !strings.HasPrefix(line, "{") {
+				parse = parseLegacyRecord
+			} else {
+				if err := checkHeader(line); err != nil {
+					return nil, &parseError{path, n, err}
+				}
+				parse = parseRecord
+				continue
+			}
+		}
+		r, err := parse(line)
+		if err != nil {
+			return nil, &parseError{path, n, err}
+		}
+		r.line = n
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// checkHeader returns an error if line is not the header of a data file this version can read
+func checkHeader(line string) error {
+	var h dataHeader
+	if err := json.Unmarshal([]byte(line), &h); err != nil {
+		return fmt.Errorf("invalid header: %v", err)
+	}
+	if h.Format != dataFormat {
+		return fmt.Errorf("unknown format %q", h.Format)
+	}
+	if h.Version < 1 || h.Version > dataFormatVersion {
+		return fmt.Errorf("unsupported version %d, expected at most %d", h.Version, dataFormatVersion)
+	}
+	return nil
+}
+
+// parseRecord parses a JSON record and checks that it has the fields of its type
+func parseRecord(line string) (*record, error) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.DisallowUnknownFields()
+	r := &record{}
+	if err := dec.Decode(r); err != nil {
+		return nil, err
+	}
+	if r.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	if _, err := metricCombination(r); err != nil {
+		return nil, err
+	}
+	if len(r.Points) > 0 && (r.Timestamp != 0 || r.Value != nil || r.Sum != 0 || r.Count != 0 || r.Buckets != nil ||
+		r.Quantiles != nil) {
+		return nil, fmt.Errorf("%s %s has both points and a single value", r.Type, r.Name)
+	}
+	for i := range r.points() {
+		if err := checkPoint(r.at(i)); err != nil {
+			if len(r.Points) > 0 {
+				return nil, fmt.Errorf("point %d: %v", i, err)
+			}
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// checkPoint returns an error if the single point r does not have the fields of its type
+func checkPoint(r *record) error {
+	switch r.Type {
+	case gauge, counter:
+		if r.Value == nil {
+			return fmt.Errorf("missing value of %s %s", r.Type, r.Name)
+		}
+		if r.ValueType != doubleValue && *r.Value != math.Trunc(*r.Value) {
+			return fmt.Errorf("value %v of %s %s is not an integer", *r.Value, r.Type, r.Name)
+		}
+	case histogram:
+		if len(r.Buckets) != len(r.Bounds) && len(r.Buckets) != len(r.Bounds)+1 {
+			return fmt.Errorf("histogram %s has %d buckets for %d bounds", r.Name, len(r.Buckets), len(r.Bounds))
+		}
+	case summary:
+		for _, q := range r.Quantiles {
+			if q.Quantile < 0 || q.Quantile > 1 {
+				return fmt.Errorf("quantile %v of summary %s is not in [0, 1]", q.Quantile, r.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid metric type %q", r.Type)
+	}
+	return nil
+}
+
+// parseLegacyRecord parses a line of the legacy text format. Histogram bounds and summary quantiles are not part of
+// the format and are taken from the bounds and quantiles options.
+func parseLegacyRecord(line string) (*record, error) {
+	params := strings.Split(line, delimeter)
+	if len(params) != 4 {
+		return nil, fmt.Errorf("expected 4 fields, got %d", len(params))
+	}
+
+	labelSet := strings.Fields(params[2])
+	if len(labelSet)%2 != 0 {
+		return nil, fmt.Errorf("labels must come in pairs: %q", params[2])
+	}
+	r := &record{
+		Name:   strings.Trim(params[0], space),
+		Type:   strings.Trim(params[1], space),
+		Labels: make(map[string]string, len(labelSet)/2),
+	}
+	for i := 0; i < len(labelSet); i += 2 {
+		r.Labels[labelSet[i]] = labelSet[i+1]
+	}
+
+	values := params[3]
+	switch r.Type {
+	case gauge, counter:
+		v, err := parseNumber(values)
+		if err != nil {
+			return nil, fmt.Errorf("value of %s %s: %v", r.Type, r.Name, err)
+		}
+		r.Value = &v
+	case histogram:
+		val, err := parseuUInt64Slice(values)
+		if err != nil {
+			return nil, fmt.Errorf("values of histogram %s: %v", r.Name, err)
+		}
+		if len(val) < 2 {
+			return nil, fmt.Errorf("histogram %s needs a sum and a count", r.Name)
+		}
+		r.Sum = float64(val[0])
+		r.Count = val[1]
+		r.Buckets = val[2:]
+		r.Bounds = bounds
+	case summary:
+		val, err := parseFloat64Slice(values)
+		if err != nil {
+			return nil, fmt.Errorf("values of summary %s: %v", r.Name, err)
+		}
+		if len(val) < 2 {
+			return nil, fmt.Errorf("summary %s needs a sum and a count", r.Name)
+		}
+		r.Sum = val[0]
+		r.Count = uint64(val[1])
+		for i, v := range val[2:] {
+			q := quantile{Value: v}
+			if i < len(quantiles) {
+				q.Quantile = quantiles[i]
+			}
+			r.Quantiles = append(r.Quantiles, q)
+		}
+	default:
+		return nil, fmt.Errorf("invalid metric type %q", r.Type)
+	}
+	return r, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_readDataFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datafile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data.jsonl")
+
+	one, two := 1.5, 2.5
+	records := []*record{
+		{Name: "gauge", Type: gauge, ValueType: doubleValue, Labels: map[string]string{label11: value11}, Value: &one,
+			Timestamp: 1e9, Resource: map[string]string{"service.name": "test"}, Library: "lib", LibraryVersion: "v1"},
+		{Name: "delta", Type: counter, Temporality: "delta", Description: "description", Unit: "s", Value: new(float64)},
+		{Name: "series", Type: gauge, ValueType: doubleValue, Points: []point{{Value: &one}, {Timestamp: 2e9, Value: &two}}},
+		{Name: "histogram", Type: histogram, Sum: 10, Count: 6, Bounds: []float64{1, 2}, Buckets: []uint64{1, 2, 3}},
+		{Name: "summary", Type: summary, OTLPType: "invalid_type", NoDescriptor: true, Sum: 10, Count: 3,
+			Quantiles: []quantile{{0, 1}, {0.5, 2}, {1, 7}}},
+	}
+	writeRecords(t, path, records...)
+	got, err := readDataFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header is the first line
+	for i, r := range records {
+		r.line = i + 2
+	}
+	if !reflect.DeepEqual(got, records) {
+		t.Errorf("got %+v,\nwant %+v", got, records)
+	}
+}
+
+func Test_readDataFileLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datafile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := tempFile(t, dir, "data.txt", "\n"+
+		"gauge, gauge, label1 value1 label2 value2 , 5\n"+
+		"\n"+
+		"histogram, histogram, , 10 6 1 2 3\n"+
+		"summary, summary, label1 value1 , 10 3 1 2 7\n")
+
+	five := 5.0
+	want := []*record{
+		{Name: "gauge", Type: gauge, Labels: map[string]string{"label1": "value1", "label2": "value2"}, Value: &five,
+			line: 2},
+		{Name: "histogram", Type: histogram, Labels: map[string]string{}, Sum: 10, Count: 6, Bounds: bounds,
+			Buckets: []uint64{1, 2, 3}, line: 4},
+		{Name: "summary", Type: summary, Labels: map[string]string{"label1": "value1"}, Sum: 10, Count: 3,
+			Quantiles: []quantile{{quantiles[0], 1}, {quantiles[1], 2}, {quantiles[2], 7}}, line: 5},
+	}
+	got, err := readDataFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v,\nwant %+v", got, want)
+	}
+}
+
+func Test_readDataFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datafile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	header := `{"format":"cortex-exporter-test-data","version":1}` + "\n"
+	tests := []struct {
+		name     string
+		content  string
+		wantLine int
+		wantErr  string
+	}{
+		{"invalid_header", `{"format":` + "\n", 1, "invalid header"},
+		{"unknown_format", `{"format":"csv","version":1}` + "\n", 1, `unknown format "csv"`},
+		{"version_0", `{"format":"cortex-exporter-test-data"}` + "\n", 1, "unsupported version 0, expected at most 1"},
+		{"version_2", `{"format":"cortex-exporter-test-data","version":2}` + "\n", 1,
+			"unsupported version 2, expected at most 1"},
+		{"unknown_field", header + `{"name":"a","type":"gauge","valu":1}` + "\n", 2, `unknown field "valu"`},
+		{"missing_name", header + "\n" + `{"type":"gauge","value":1}` + "\n", 3, "missing name"},
+		{"points_and_value", header + `{"name":"a","type":"gauge","value":1,"points":[{"value":1}]}` + "\n", 2,
+			"gauge a has both points and a single value"},
+		{"point", header + `{"name":"a","type":"gauge","points":[{"value":1},{}]}` + "\n", 2,
+			"point 1: missing value of gauge a"},
+		{"not_an_integer", header + `{"name":"a","type":"counter","value":1.5}` + "\n", 2,
+			"value 1.5 of counter a is not an integer"},
+		{"buckets", header + `{"name":"a","type":"histogram","bounds":[1],"buckets":[1,2,3]}` + "\n", 2,
+			"histogram a has 3 buckets for 1 bounds"},
+		{"legacy_fields", "a, gauge, 1\n", 1, "expected 4 fields, got 3"},
+		{"legacy_type", "a, gauge, , 1\nb, untyped, , 1\n", 2, `invalid metric type "untyped"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tempFile(t, dir, tt.name, tt.content)
+			_, err := readDataFile(path)
+			var parseErr *parseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("got %v, want a parseError", err)
+			}
+			if parseErr.path != path || parseErr.line != tt.wantLine || !strings.Contains(parseErr.err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want line %d of %s and an error containing %q", err, tt.wantLine, path, tt.wantErr)
+			}
+		})
+	}
+}
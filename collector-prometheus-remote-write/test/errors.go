@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// parseError is an error in a line of a data file
+type parseError struct {
+	path string
+	line int
+	err  error
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.path, e.line, e.err)
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// metricError is a failure of a single metric in a stage
+type metricError struct {
+	name  string
+	mType string
+	err   error
+}
+
+func (e *metricError) Error() string {
+	return fmt.Sprintf("%s (%s): %v", e.name, e.mType, e.err)
+}
+
+func (e *metricError) Unwrap() error {
+	return e.err
+}
+
+// stageErrors collects the failures of a stage that ran to completion, so that the following stages can still run.
+// Any other error returned by a stage stops the test.
+type stageErrors []error
+
+func (e stageErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%d failures, first: %v", len(e), e[0])
+}
+
+// err returns nil if no failure was collected
+func (e stageErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// stageFailure is the error returned by a stage
+type stageFailure struct {
+	stage string
+	err   error
+}
+
+// reportFailures logs every failure of every stage at the end of a run
+func reportFailures(failures []stageFailure) {
+	log.Println("summary of failures:")
+	for _, f := range failures {
+		var errs stageErrors
+		if !errors.As(f.err, &errs) {
+			log.Printf("%s: %v\n", f.stage, f.err)
+			continue
+		}
+		log.Printf("%s: %d failure(s)\n", f.stage, len(errs))
+		for _, err := range errs {
+			log.Printf("\t%v\n", err)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	nameStr      = "__name__"
+	signatureSep = "\xff" // cannot appear in valid UTF-8 label names or values
+)
+
+// lookbackDelta is how far back from an evaluation time a query looks for the latest sample, like in Prometheus
+const lookbackDelta = 5 * time.Minute
+
+// fakeCortex is an in-memory remote write backend. It stores every TimeSeries it receives and serves the part of the
+// Prometheus query API used by the querier, so that the pipeline test can run without a Cortex instance.
+type fakeCortex struct {
+	mu       sync.Mutex
+	series   map[string]*prompb.TimeSeries // keyed by the signature of the label set
+	listener net.Listener
+	server   *http.Server
+}
+
+// queryResponse is the body of a Prometheus query response
+type queryResponse struct {
+	Status    string     `json:"status"`
+	Data      *queryData `json:"data,omitempty"`
+	ErrorType string     `json:"errorType,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"` // []vectorSample or []matrixSeries
+}
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"` // timestamp in seconds and the value as a string
+}
+
+type matrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+// startFakeCortex listens on addr and serves remote write requests on /api/v1/push and /api/prom/push, instant queries
+// of selectors and range selectors on /api/v1/query and /api/prom/api/v1/query, and range queries on /api/v1/query_range and
+// /api/prom/api/v1/query_range.
+func startFakeCortex(addr string) (*fakeCortex, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &fakeCortex{
+		series:   make(map[string]*prompb.TimeSeries),
+		listener: listener,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/push", c.handleWrite)
+	mux.HandleFunc("/api/prom/push", c.handleWrite)
+	mux.HandleFunc("/api/v1/query", c.handleQuery)
+	mux.HandleFunc("/api/prom/api/v1/query", c.handleQuery)
+	mux.HandleFunc("/api/v1/query_range", c.handleQueryRange)
+	mux.HandleFunc("/api/prom/api/v1/query_range", c.handleQueryRange)
+	c.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := c.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+	return c, nil
+}
+
+// URL returns the base URL of the server
+func (c *fakeCortex) URL() string {
+	return "http://" + c.listener.Addr().String()
+}
+
+func (c *fakeCortex) close() error {
+	return c.server.Close()
+}
+
+// handleWrite decodes a snappy-compressed WriteRequest and appends its samples to the stored TimeSeries
+func (c *fakeCortex) handleWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range req.Timeseries {
+		ts := req.Timeseries[i]
+		sig := labelSignature(ts.Labels)
+		stored, ok := c.series[sig]
+		if !ok {
+			c.series[sig] = &ts
+			continue
+		}
+		stored.Samples = append(stored.Samples, ts.Samples...)
+	}
+}
+
+// handleQuery evaluates a selector of the form name or name{label="value",...} at the time parameter, or now if it is
+// not set, and returns the latest sample of each matching TimeSeries at most lookbackDelta before it, timestamped with
+// the evaluation time. A range selector like name[5m] returns every sample in the range, with its own timestamp.
+func (c *fakeCortex) handleQuery(w http.ResponseWriter, r *http.Request) {
+	selector, window, err := parseRangeSelector(r.FormValue("query"))
+	if err != nil {
+		writeBadData(w, err)
+		return
+	}
+	matchers, err := parseSelector(selector)
+	if err != nil {
+		writeBadData(w, err)
+		return
+	}
+	t := time.Now()
+	if param := r.FormValue("time"); param != "" {
+		if t, err = parseTime(param); err != nil {
+			writeBadData(w, fmt.Errorf("invalid time: %v", err))
+			return
+		}
+	}
+	ms := t.UnixNano() / int64(time.Millisecond)
+
+	if window > 0 {
+		result := []matrixSeries{}
+		for _, ts := range c.matching(matchers) {
+			var values [][2]interface{}
+			for _, sample := range ts.Samples {
+				if sample.Timestamp > ms-int64(window/time.Millisecond) && sample.Timestamp <= ms {
+					values = append(values, [2]interface{}{float64(sample.Timestamp) / 1000, formatSampleValue(sample.Value)})
+				}
+			}
+			if len(values) > 0 {
+				result = append(result, matrixSeries{Metric: labelMap(ts.Labels), Values: values})
+			}
+		}
+		writeQueryResponse(w, http.StatusOK, &queryResponse{
+			Status: "success",
+			Data:   &queryData{ResultType: "matrix", Result: result},
+		})
+		return
+	}
+
+	result := []vectorSample{}
+	for _, ts := range c.matching(matchers) {
+		if sample, ok := latestSample(ts.Samples, ms); ok {
+			result = append(result, vectorSample{
+				Metric: labelMap(ts.Labels),
+				Value:  [2]interface{}{float64(ms) / 1000, formatSampleValue(sample.Value)},
+			})
+		}
+	}
+
+	writeQueryResponse(w, http.StatusOK, &queryResponse{
+		Status: "success",
+		Data:   &queryData{ResultType: "vector", Result: result},
+	})
+}
+
+// latestSample returns the latest of the sorted samples at ms, if it is at most lookbackDelta before ms
+func latestSample(samples []prompb.Sample, ms int64) (prompb.Sample, bool) {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp > ms })
+	if i == 0 || samples[i-1].Timestamp <= ms-int64(lookbackDelta/time.Millisecond) {
+		return prompb.Sample{}, false
+	}
+	return samples[i-1], true
+}
+
+// handleQueryRange evaluates a selector at each step from start to end, and returns the samples of each matching
+// TimeSeries. The sample at an evaluation time is the latest one at most lookbackDelta before it.
+func (c *fakeCortex) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	matchers, err := parseSelector(r.FormValue("query"))
+	if err != nil {
+		writeBadData(w, err)
+		return
+	}
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		writeBadData(w, fmt.Errorf("invalid start: %v", err))
+		return
+	}
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil {
+		writeBadData(w, fmt.Errorf("invalid end: %v", err))
+		return
+	}
+	step, err := parseStep(r.FormValue("step"))
+	if err != nil {
+		writeBadData(w, fmt.Errorf("invalid step: %v", err))
+		return
+	}
+	if end.Before(start) {
+		writeBadData(w, errors.New("end timestamp must not be before start time"))
+		return
+	}
+	if end.Sub(start)/step > 11000 {
+		writeBadData(w, errors.New("exceeded maximum resolution of 11,000 points per timeseries"))
+		return
+	}
+
+	result := []matrixSeries{}
+	for _, ts := range c.matching(matchers) {
+		var values [][2]interface{}
+		for t := start; !t.After(end); t = t.Add(step) {
+			ms := t.UnixNano() / int64(time.Millisecond)
+			if sample, ok := latestSample(ts.Samples, ms); ok {
+				values = append(values, [2]interface{}{float64(ms) / 1000, formatSampleValue(sample.Value)})
+			}
+		}
+		if len(values) > 0 {
+			result = append(result, matrixSeries{Metric: labelMap(ts.Labels), Values: values})
+		}
+	}
+
+	writeQueryResponse(w, http.StatusOK, &queryResponse{
+		Status: "success",
+		Data:   &queryData{ResultType: "matrix", Result: result},
+	})
+}
+
+// matching returns a copy of every TimeSeries with samples that matches matchers, with the samples sorted by
+// timestamp and without duplicates. Like in Prometheus, the series are sorted by their label sets.
+func (c *fakeCortex) matching(matchers map[string]string) []prompb.TimeSeries {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sigs := make([]string, 0, len(c.series))
+	for sig := range c.series {
+		sigs = append(sigs, sig)
+	}
+	sort.Strings(sigs)
+
+	var result []prompb.TimeSeries
+	for _, sig := range sigs {
+		ts := c.series[sig]
+		if len(ts.Samples) == 0 || !matchLabels(ts.Labels, matchers) {
+			continue
+		}
+		samples := append([]prompb.Sample{}, ts.Samples...)
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+		// like in Prometheus, a sample with the timestamp of an earlier one is a duplicate and is dropped
+		unique := samples[:1]
+		for _, sample := range samples[1:] {
+			if sample.Timestamp != unique[len(unique)-1].Timestamp {
+				unique = append(unique, sample)
+			}
+		}
+		result = append(result, prompb.TimeSeries{Labels: ts.Labels, Samples: unique})
+	}
+	return result
+}
+
+func labelMap(labels []prompb.Label) map[string]string {
+	result := make(map[string]string, len(labels))
+	for _, l := range labels {
+		result[l.Name] = l.Value
+	}
+	return result
+}
+
+func writeBadData(w http.ResponseWriter, err error) {
+	writeQueryResponse(w, http.StatusBadRequest, &queryResponse{Status: "error", ErrorType: "bad_data", Error: err.Error()})
+}
+
+func writeQueryResponse(w http.ResponseWriter, status int, res *queryResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Println(err)
+	}
+}
+
+// parseSelector parses a metric name with optional equality matchers into a map of label names to values. Label
+// values must be double-quoted and must not contain commas.
+func parseSelector(query string) (map[string]string, error) {
+	query = strings.TrimSpace(query)
+	matchers := make(map[string]string)
+	name := query
+	if i := strings.Index(query, "{"); i >= 0 {
+		if !strings.HasSuffix(query, "}") {
+			return nil, fmt.Errorf("unclosed selector %q", query)
+		}
+		name = strings.TrimSpace(query[:i])
+		for _, m := range strings.Split(query[i+1:len(query)-1], delimeter) {
+			if strings.TrimSpace(m) == "" {
+				continue
+			}
+			pair := strings.SplitN(m, "=", 2)
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("invalid matcher %q", m)
+			}
+			value, err := strconv.Unquote(strings.TrimSpace(pair[1]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid matcher %q", m)
+			}
+			matchers[strings.TrimSpace(pair[0])] = value
+		}
+	}
+	if name != "" {
+		matchers[nameStr] = name
+	}
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return matchers, nil
+}
+
+// parseRangeSelector splits a range selector like name{label="value"}[5m] into the selector and the range. The range
+// is zero if query is not a range selector.
+func parseRangeSelector(query string) (string, time.Duration, error) {
+	query = strings.TrimSpace(query)
+	if !strings.HasSuffix(query, "]") {
+		return query, 0, nil
+	}
+	i := strings.LastIndex(query, "[")
+	if i < 0 {
+		return "", 0, fmt.Errorf("unopened range in %q", query)
+	}
+	window, err := time.ParseDuration(query[i+1 : len(query)-1])
+	if err != nil || window <= 0 {
+		return "", 0, fmt.Errorf("invalid range in %q", query)
+	}
+	return query[:i], window, nil
+}
+
+// matchLabels returns true if labels has every label in matchers
+func matchLabels(labels []prompb.Label, matchers map[string]string) bool {
+	matched := 0
+	for _, l := range labels {
+		if value, ok := matchers[l.Name]; ok {
+			if value != l.Value {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(matchers)
+}
+
+// labelSignature returns a string that uniquely identifies a label set regardless of the order of the labels
+func labelSignature(labels []prompb.Label) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = l.Name + signatureSep + l.Value
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, signatureSep)
+}
+
+// parseTime parses a query API timestamp, either in unix seconds or in RFC 3339. Like in Prometheus, unix seconds are
+// rounded to milliseconds, so that times a whole number of steps apart stay so despite the float precision.
+func parseTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(math.Round(fraction*1000))*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// parseStep parses a query API step, either in seconds or as a duration
+func parseStep(s string) (time.Duration, error) {
+	step, err := time.ParseDuration(s)
+	if seconds, floatErr := strconv.ParseFloat(s, 64); floatErr == nil {
+		step, err = time.Duration(seconds*float64(time.Second)), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if step <= 0 {
+		return 0, errors.New("zero or negative query resolution step widths are not accepted")
+	}
+	return step, nil
+}
+
+// formatSampleValue formats v the way the Prometheus HTTP API does
+func formatSampleValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// series returns a TimeSeries of the metric name with labels, given as name and value pairs, and samples of a value at
+// each timestamp in milliseconds, given as pairs too
+func series(name string, labels []string, samples ...float64) prompb.TimeSeries {
+	ts := prompb.TimeSeries{Labels: []prompb.Label{{Name: nameStr, Value: name}}}
+	for i := 0; i+1 < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	for i := 0; i+1 < len(samples); i += 2 {
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: samples[i], Timestamp: int64(samples[i+1])})
+	}
+	return ts
+}
+
+// push sends a remote write request of series to the fake Cortex at baseURL and returns the status code
+func push(t *testing.T, baseURL string, series ...prompb.TimeSeries) int {
+	buf, err := (&prompb.WriteRequest{Timeseries: series}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(baseURL+"/api/v1/push", "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func Test_fakeCortexWrite(t *testing.T) {
+	c, err := startFakeCortex("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	if code := push(t, c.URL(), series("a", []string{"l", "1"}, 1, 1000), series("b", nil, 2, 1000)); code != http.StatusOK {
+		t.Fatalf("push: got status %d", code)
+	}
+	// the samples of a series written again are appended, whatever the order of its labels
+	again := series("a", []string{"l", "1"}, 3, 2000)
+	again.Labels[0], again.Labels[1] = again.Labels[1], again.Labels[0]
+	if code := push(t, c.URL(), again); code != http.StatusOK {
+		t.Fatalf("push: got status %d", code)
+	}
+	if n := len(c.series); n != 2 {
+		t.Errorf("got %d series, want 2", n)
+	}
+	got := c.series[labelSignature(again.Labels)]
+	if want := series("a", []string{"l", "1"}, 1, 1000, 3, 2000).Samples; got == nil || !reflect.DeepEqual(got.Samples, want) {
+		t.Errorf("got %v, want samples %v", got, want)
+	}
+
+	res, err := http.Get(c.URL() + "/api/v1/push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got status %d, want %d", res.StatusCode, http.StatusMethodNotAllowed)
+	}
+	res, err = http.Post(c.URL()+"/api/prom/push", "application/x-protobuf", strings.NewReader("not snappy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid body: got status %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func Test_fakeCortexQuery(t *testing.T) {
+	c, err := startFakeCortex("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	// written out of order, with a duplicate sample at 2000ms that is dropped
+	push(t, c.URL(), series("m", []string{"l", "1"}, 2, 2000, 1, 1000), series("m", []string{"l", "2"}, 5, 1500))
+	push(t, c.URL(), series("m", []string{"l", "1"}, 9, 2000), series("other", nil, 7, 1000))
+
+	tests := []struct {
+		name    string
+		path    string
+		params  url.Values
+		status  int
+		want    string // the result, or the error if the status is not OK
+		wantErr string
+	}{
+		{"instant", "/api/v1/query", url.Values{"query": {"m"}, "time": {"2.5"}}, http.StatusOK,
+			`[{"metric":{"__name__":"m","l":"1"},"value":[2.5,"2"]},{"metric":{"__name__":"m","l":"2"},"value":[2.5,"5"]}]`, ""},
+		{"matcher", "/api/prom/api/v1/query", url.Values{"query": {`m{l="2"}`}, "time": {"2.5"}}, http.StatusOK,
+			`[{"metric":{"__name__":"m","l":"2"},"value":[2.5,"5"]}]`, ""},
+		{"before_first_sample", "/api/v1/query", url.Values{"query": {`m{l="2"}`}, "time": {"1"}}, http.StatusOK, `[]`, ""},
+		{"lookback", "/api/v1/query", url.Values{"query": {"m"}, "time": {"302"}}, http.StatusOK, `[]`, ""},
+		{"range_selector", "/api/v1/query", url.Values{"query": {`m{l="1"}[1500ms]`}, "time": {"2"}}, http.StatusOK,
+			`[{"metric":{"__name__":"m","l":"1"},"values":[[1,"1"],[2,"2"]]}]`, ""},
+		{"range_selector_excludes_start", "/api/v1/query", url.Values{"query": {`m{l="1"}[1s]`}, "time": {"2"}},
+			http.StatusOK, `[{"metric":{"__name__":"m","l":"1"},"values":[[2,"2"]]}]`, ""},
+		{"range", "/api/v1/query_range", url.Values{"query": {"m"}, "start": {"1"}, "end": {"3"}, "step": {"1"}},
+			http.StatusOK, `[{"metric":{"__name__":"m","l":"1"},"values":[[1,"1"],[2,"2"],[3,"2"]]},` +
+				`{"metric":{"__name__":"m","l":"2"},"values":[[2,"5"],[3,"5"]]}]`, ""},
+		{"range_duration_step", "/api/prom/api/v1/query_range",
+			url.Values{"query": {"other"}, "start": {"1970-01-01T00:00:01Z"}, "end": {"2"}, "step": {"500ms"}},
+			http.StatusOK, `[{"metric":{"__name__":"other"},"values":[[1,"7"],[1.5,"7"],[2,"7"]]}]`, ""},
+		{"invalid_matcher", "/api/v1/query", url.Values{"query": {"m{l=1}"}}, http.StatusBadRequest, "", "invalid matcher"},
+		{"invalid_range", "/api/v1/query", url.Values{"query": {"m[5x]"}}, http.StatusBadRequest, "", "invalid range"},
+		{"invalid_time", "/api/v1/query", url.Values{"query": {"m"}, "time": {"now"}}, http.StatusBadRequest, "",
+			"invalid time"},
+		{"end_before_start", "/api/v1/query_range", url.Values{"query": {"m"}, "start": {"3"}, "end": {"1"}, "step": {"1"}},
+			http.StatusBadRequest, "", "end timestamp must not be before start time"},
+		{"zero_step", "/api/v1/query_range", url.Values{"query": {"m"}, "start": {"1"}, "end": {"3"}, "step": {"0"}},
+			http.StatusBadRequest, "", "zero or negative query resolution step"},
+		{"too_many_points", "/api/v1/query_range",
+			url.Values{"query": {"m"}, "start": {"0"}, "end": {"20000"}, "step": {"1"}}, http.StatusBadRequest, "",
+			"exceeded maximum resolution"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Get(c.URL() + tt.path + "?" + tt.params.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			var body struct {
+				Status string `json:"status"`
+				Data   struct {
+					Result json.RawMessage `json:"result"`
+				} `json:"data"`
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Fatalf("got status %d, want %d: %s", res.StatusCode, tt.status, body.Error)
+			}
+			if tt.wantErr != "" {
+				if body.Status != "error" || !strings.Contains(body.Error, tt.wantErr) {
+					t.Errorf("got %s %q, want an error containing %q", body.Status, body.Error, tt.wantErr)
+				}
+				return
+			}
+			if got := string(body.Data.Result); got != tt.want {
+				t.Errorf("got %s,\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseSelector(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"metric", map[string]string{nameStr: "metric"}, false},
+		{` metric{ a="1", b = "x y" } `, map[string]string{nameStr: "metric", "a": "1", "b": "x y"}, false},
+		{`{a="1"}`, map[string]string{"a": "1"}, false},
+		{`metric{}`, map[string]string{nameStr: "metric"}, false},
+		{`metric{a="°"}`, map[string]string{nameStr: "metric", "a": "°"}, false},
+		{"", nil, true},
+		{"{}", nil, true},
+		{`metric{a="1"`, nil, true},
+		{`metric{a}`, nil, true},
+		{`metric{a=1}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parseSelector(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseRangeSelector(t *testing.T) {
+	tests := []struct {
+		query    string
+		selector string
+		window   time.Duration
+		wantErr  bool
+	}{
+		{"metric", "metric", 0, false},
+		{`metric{a="1"}[60000ms]`, `metric{a="1"}`, time.Minute, false},
+		{" metric[5m] ", "metric", 5 * time.Minute, false},
+		{"metric]", "", 0, true},
+		{"metric[5]", "", 0, true},
+		{"metric[0s]", "", 0, true},
+		{"metric[-1s]", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			selector, window, err := parseRangeSelector(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if selector != tt.selector || window != tt.window {
+				t.Errorf("got %q %v, want %q %v", selector, window, tt.selector, tt.window)
+			}
+		})
+	}
+}
+
+func Test_parseTime(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    time.Time
+		wantErr bool
+	}{
+		{"1792202494.729", time.Unix(1792202494, 729*int64(time.Millisecond)), false},
+		{"1792202495.329", time.Unix(1792202495, 329*int64(time.Millisecond)), false},
+		{"1.5", time.Unix(1, 500*int64(time.Millisecond)), false},
+		{"2026-10-17T01:54:30.25Z", time.Date(2026, 10, 17, 1, 54, 30, 250*int(time.Millisecond), time.UTC), false},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			got, err := parseTime(tt.str)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// three steps of 200ms apart, however the times are rounded
+	start, _ := parseTime("1792202494.729")
+	end, _ := parseTime("1792202495.329")
+	if end.Sub(start) != 600*time.Millisecond {
+		t.Errorf("got %v between start and end, want 600ms", end.Sub(start))
+	}
+}
+
+func Test_parseStep(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"15", 15 * time.Second, false},
+		{"0.5", 500 * time.Millisecond, false},
+		{"1m", time.Minute, false},
+		{"0", 0, true},
+		{"-1s", 0, true},
+		{"often", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			got, err := parseStep(tt.str)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	service "github.com/open-telemetry/opentelemetry-proto/gen/go/collector/metrics/v1"
+	common "github.com/open-telemetry/opentelemetry-proto/gen/go/common/v1"
+	metrics "github.com/open-telemetry/opentelemetry-proto/gen/go/metrics/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeCollector is an OTLP metrics receiver that records every request it receives, so that the metrics built by the
+// sender can be checked without a running Collector
+type fakeCollector struct {
+	mu       sync.Mutex
+	requests []*service.ExportMetricsServiceRequest
+	listener net.Listener
+	server   *grpc.Server
+}
+
+// startFakeCollector serves the OTLP MetricsService on addr
+func startFakeCollector(addr string) (*fakeCollector, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &fakeCollector{
+		listener: listener,
+		server:   grpc.NewServer(),
+	}
+	service.RegisterMetricsServiceServer(c.server, c)
+
+	go func() {
+		if err := c.server.Serve(listener); err != nil {
+			log.Println(err)
+		}
+	}()
+	return c, nil
+}
+
+// Export records req
+func (c *fakeCollector) Export(ctx context.Context, req *service.ExportMetricsServiceRequest) (*service.ExportMetricsServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+	return &service.ExportMetricsServiceResponse{}, nil
+}
+
+// addr returns the address the server listens on
+func (c *fakeCollector) addr() string {
+	return c.listener.Addr().String()
+}
+
+func (c *fakeCollector) close() {
+	c.server.Stop()
+}
+
+// receivedMetric is a metric with the resource and instrumentation library it was received with
+type receivedMetric struct {
+	*metrics.Metric
+	resource       map[string]string
+	library        string
+	libraryVersion string
+}
+
+// receivedMetrics returns every metric received so far, in the order they were received
+func (c *fakeCollector) receivedMetrics() []*receivedMetric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var result []*receivedMetric
+	for _, req := range c.requests {
+		for _, rm := range req.ResourceMetrics {
+			attrs := make(map[string]string)
+			for _, kv := range rm.GetResource().GetAttributes() {
+				attrs[kv.Key] = kv.GetValue().GetStringValue()
+			}
+			for _, ilm := range rm.InstrumentationLibraryMetrics {
+				for _, m := range ilm.Metrics {
+					result = append(result, &receivedMetric{m, attrs, ilm.GetInstrumentationLibrary().GetName(),
+						ilm.GetInstrumentationLibrary().GetVersion()})
+				}
+			}
+		}
+	}
+	return result
+}
+
+// checkReceived compares the metrics received by c with the records in the input file. Metrics are matched by name,
+// since concurrent workers send them in any order and a load test sends each of them many times. It returns a
+// metricError for each record that was not received or does not match a metric received for it.
+func (c *fakeCollector) checkReceived(inputPath string) error {
+	expected, err := readDataFile(inputPath)
+	if err != nil {
+		return err
+	}
+	received := make(map[string][]*receivedMetric)
+	for _, m := range c.receivedMetrics() {
+		name := m.GetMetricDescriptor().GetName()
+		received[name] = append(received[name], m)
+	}
+
+	var errs stageErrors
+	nameless := 0
+	for _, exp := range expected {
+		// a metric without a descriptor has no name to match it by, so only their number is checked
+		if exp.NoDescriptor {
+			nameless += len(exp.points())
+			continue
+		}
+		ms, ok := received[exp.Name]
+		if !ok {
+			errs = append(errs, &metricError{exp.Name, exp.Type, fmt.Errorf("line %d was not received", exp.line)})
+			continue
+		}
+		delete(received, exp.Name)
+		// the points of a time series are sent in order, one round at a time
+		points := len(exp.points())
+		if len(ms) < points {
+			err := fmt.Errorf("line %d: received %d of %d points", exp.line, len(ms), points)
+			errs = append(errs, &metricError{exp.Name, exp.Type, err})
+			continue
+		}
+		for i, m := range ms {
+			if mismatches := compareMetric(exp.at(i%points), m); len(mismatches) > 0 {
+				if points > 1 {
+					mismatches[0] = fmt.Sprintf("point %d: %s", i%points, mismatches[0])
+				}
+				err := fmt.Errorf("line %d: %s", exp.line, strings.Join(mismatches, "; "))
+				errs = append(errs, &metricError{exp.Name, exp.Type, err})
+				break
+			}
+		}
+	}
+	if n := len(received[""]); n < nameless {
+		errs = append(errs, fmt.Errorf("received %d metrics without a descriptor, expected %d", n, nameless))
+	}
+	delete(received, "")
+	for name, ms := range received {
+		errs = append(errs, fmt.Errorf("received %d metric(s) named %s, which is not in the input file", len(ms), name))
+	}
+
+	log.Printf("checked %d sent metrics: %d failed\n", len(expected), len(errs))
+	return errs.err()
+}
+
+// compareMetric returns a description of every difference between a record of the input file and the metric built
+// from it
+func compareMetric(exp *record, m *receivedMetric) []string {
+	act, err := recordFromMetric(m.Metric)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	act.Resource, act.Library, act.LibraryVersion = m.resource, m.library, m.libraryVersion
+
+	var mismatches []string
+	if comb, err := metricCombination(exp); err == nil {
+		if desc := m.GetMetricDescriptor(); desc.Type != comb.ty || desc.Temporality != comb.temp {
+			mismatches = append(mismatches, fmt.Sprintf("type and temporality: expected %v %v, got %v %v",
+				comb.ty, comb.temp, desc.Type, desc.Temporality))
+		}
+	}
+	if act.Name != exp.Name {
+		mismatches = append(mismatches, fmt.Sprintf("name: expected %s, got %s", exp.Name, act.Name))
+	}
+	if act.Description != exp.Description || act.Unit != exp.Unit {
+		mismatches = append(mismatches, fmt.Sprintf("description and unit: expected %q %q, got %q %q",
+			exp.Description, exp.Unit, act.Description, act.Unit))
+	}
+	if labelMapSignature(act.Labels) != labelMapSignature(exp.Labels) {
+		mismatches = append(mismatches, fmt.Sprintf("labels: expected %v, got %v", exp.Labels, act.Labels))
+	}
+	if labelMapSignature(act.Resource) != labelMapSignature(exp.Resource) {
+		mismatches = append(mismatches, fmt.Sprintf("resource: expected %v, got %v", exp.Resource, act.Resource))
+	}
+	if act.Library != exp.Library || act.LibraryVersion != exp.LibraryVersion {
+		mismatches = append(mismatches, fmt.Sprintf("instrumentation library: expected %q %q, got %q %q",
+			exp.Library, exp.LibraryVersion, act.Library, act.LibraryVersion))
+	}
+	if exp.Timestamp != 0 && act.Timestamp != exp.Timestamp {
+		mismatches = append(mismatches, fmt.Sprintf("timestamp: expected %d, got %d", exp.Timestamp, act.Timestamp))
+	}
+	if fmt.Sprint(act.Bounds) != fmt.Sprint(exp.Bounds) {
+		mismatches = append(mismatches, fmt.Sprintf("explicit bounds: expected %v, got %v", exp.Bounds, act.Bounds))
+	}
+	for i := 0; i < len(exp.Quantiles) && i < len(act.Quantiles); i++ {
+		if exp.Quantiles[i].Quantile != act.Quantiles[i].Quantile {
+			mismatches = append(mismatches, fmt.Sprintf("percentile %d: expected %v, got %v", i,
+				exp.Quantiles[i].Quantile, act.Quantiles[i].Quantile))
+		}
+	}
+	return append(mismatches, compareRecords(exp, act)...)
+}
+
+// recordFromMetric converts a metric with a single data point back to the record it was built from
+func recordFromMetric(m *metrics.Metric) (*record, error) {
+	desc := m.GetMetricDescriptor()
+	r := &record{
+		Name:        desc.GetName(),
+		Description: desc.GetDescription(),
+		Unit:        desc.GetUnit(),
+		Labels:      make(map[string]string),
+	}
+
+	setCombination(r, combination{desc.GetType(), desc.GetTemporality()})
+	var labels []*common.StringKeyValue
+	var points int
+	// a metric of an invalid type is read as the int64 gauge it was built from
+	switch {
+	case r.ValueType == int64Value:
+		points = len(m.Int64DataPoints)
+		if points == 1 {
+			pt := m.Int64DataPoints[0]
+			labels, r.Timestamp = pt.Labels, pt.TimeUnixNano
+			v := float64(pt.Value)
+			r.Value = &v
+		}
+	case r.ValueType == doubleValue:
+		points = len(m.DoubleDataPoints)
+		if points == 1 {
+			pt := m.DoubleDataPoints[0]
+			labels, r.Timestamp = pt.Labels, pt.TimeUnixNano
+			v := pt.Value
+			r.Value = &v
+		}
+	case r.Type == histogram:
+		points = len(m.HistogramDataPoints)
+		if points == 1 {
+			pt := m.HistogramDataPoints[0]
+			labels, r.Timestamp = pt.Labels, pt.TimeUnixNano
+			r.Sum, r.Count, r.Bounds = pt.Sum, pt.Count, pt.ExplicitBounds
+			for _, bk := range pt.Buckets {
+				r.Buckets = append(r.Buckets, bk.Count)
+			}
+		}
+	case r.Type == summary:
+		points = len(m.SummaryDataPoints)
+		if points == 1 {
+			pt := m.SummaryDataPoints[0]
+			labels, r.Timestamp = pt.Labels, pt.TimeUnixNano
+			r.Sum, r.Count = pt.Sum, pt.Count
+			for _, p := range pt.PercentileValues {
+				r.Quantiles = append(r.Quantiles, quantile{Quantile: p.Percentile, Value: p.Value})
+			}
+		}
+	}
+	if points != 1 {
+		return nil, fmt.Errorf("data points: expected 1, got %d", points)
+	}
+	if n := dataPoints(m); n != points {
+		return nil, fmt.Errorf("%d data points of another type than %v", n-points, desc.GetType())
+	}
+
+	for _, l := range labels {
+		r.Labels[l.Key] = l.Value
+	}
+	return r, nil
+}
+
+// dataPoints returns the number of data points of m
+func dataPoints(m *metrics.Metric) int {
+	return len(m.Int64DataPoints) + len(m.DoubleDataPoints) + len(m.HistogramDataPoints) + len(m.SummaryDataPoints)
+}
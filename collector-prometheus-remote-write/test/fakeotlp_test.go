@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	metrics "github.com/open-telemetry/opentelemetry-proto/gen/go/metrics/v1"
+)
+
+// export passes a request of every point of records to c, the way the sender sends them
+func export(t *testing.T, c *fakeCollector, records ...*record) {
+	for _, r := range records {
+		for i := range r.points() {
+			m, err := buildMetric(r.at(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Export(context.Background(), buildRequest([]*record{r}, []*metrics.Metric{m})); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// receivedInput returns the records of a test input file, which has metrics the exporter drops and metrics without
+// a descriptor
+func receivedInput(t *testing.T, path string) []*record {
+	one, two := 1.0, 2.0
+	records := []*record{
+		{Name: "gauge", Type: gauge, Labels: map[string]string{label11: value11}, Value: &one},
+		{Name: "series", Type: gauge, Points: []point{{Value: &one}, {Value: &two}}},
+		{Name: "delta", Type: counter, Temporality: "delta", Value: &one},
+		{Name: "invalid_type", Type: gauge, OTLPType: "invalid_type", Value: &one},
+		{Name: "nameless1", Type: gauge, NoDescriptor: true, Value: &one},
+		{Name: "nameless2", Type: histogram, NoDescriptor: true, Sum: 10, Count: 6, Bounds: []float64{1, 2},
+			Buckets: []uint64{1, 2, 3}},
+	}
+	writeRecords(t, path, records...)
+	return records
+}
+
+func Test_checkReceived(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakeotlp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "data.jsonl")
+	records := receivedInput(t, input)
+	gauge, series, delta, invalidType, nameless1, nameless2 := records[0], records[1], records[2], records[3],
+		records[4], records[5]
+
+	two := 2.0
+	changed := *gauge
+	changed.Value = &two
+	firstPoint := *series
+	firstPoint.Points = series.Points[:1]
+	other := *gauge
+	other.Name = "other"
+
+	tests := []struct {
+		name     string
+		received []*record
+		wantErrs []string
+	}{
+		{"all", records, nil},
+		{"twice", append(records, records...), nil},
+		{"nameless_any_order", []*record{nameless2, series, delta, nameless1, gauge, invalidType}, nil},
+		{"too_few_nameless", []*record{gauge, series, delta, invalidType, nameless2},
+			[]string{"received 1 metrics without a descriptor, expected 2"}},
+		{"not_received", []*record{gauge, series, invalidType, nameless1, nameless2},
+			[]string{"delta (counter): line 4 was not received"}},
+		{"invalid_type_not_received", []*record{gauge, series, delta, nameless1, nameless2},
+			[]string{"invalid_type (gauge): line 5 was not received"}},
+		{"points", []*record{gauge, &firstPoint, delta, invalidType, nameless1, nameless2},
+			[]string{"series (gauge): line 3: received 1 of 2 points"}},
+		{"value", []*record{&changed, series, delta, invalidType, nameless1, nameless2},
+			[]string{"gauge (gauge): line 2: value: expected 1, got 2"}},
+		{"unexpected", append([]*record{&other}, records...),
+			[]string{"received 1 metric(s) named other, which is not in the input file"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fakeCollector{}
+			export(t, c, tt.received...)
+			err := c.checkReceived(input)
+			var errs stageErrors
+			if err != nil && !errors.As(err, &errs) {
+				t.Fatalf("got %v, want stageErrors", err)
+			}
+			var got []string
+			for _, err := range errs {
+				got = append(got, err.Error())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantErrs) {
+				t.Errorf("got %q, want %q", got, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func Test_fakeCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakeotlp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "data.jsonl")
+	receivedInput(t, input)
+
+	c, err := startFakeCollector("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	defer setLoad(loadOptions{batchSize: 2, pointInterval: time.Millisecond})()
+	savedEndpoint, savedInput, savedWait := endpoint, inputPath, waitTime
+	defer func() { endpoint, inputPath, waitTime = savedEndpoint, savedInput, savedWait }()
+	endpoint, inputPath, waitTime = c.addr(), input, 0
+
+	// the sender sends every metric of the input file over gRPC, including those the exporter drops
+	if err := createAndSendLoad(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkReceived(input); err != nil {
+		t.Error(err)
+	}
+	if got := len(c.receivedMetrics()); got != 7 {
+		t.Errorf("received %d metrics, want 7", got)
+	}
+}
@@ -4,9 +4,12 @@ go 1.14
 
 require (
 	github.com/aws/aws-sdk-go v1.34.13
-	github.com/golang/protobuf v1.4.2 // indirect
+	github.com/golang/protobuf v1.4.2
+	github.com/golang/snappy v0.0.1
 	github.com/grpc-ecosystem/grpc-gateway v1.14.7 // indirect
 	github.com/open-telemetry/opentelemetry-proto v0.4.0
+	github.com/prometheus/prometheus v1.8.2-0.20200827201422-1195cc24e3c8
 	github.com/tidwall/gjson v1.6.1
 	google.golang.org/grpc v1.31.0
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	metrics "github.com/open-telemetry/opentelemetry-proto/gen/go/metrics/v1"
+)
+
+// sendLoad sends the records with the configured number of workers and at the configured rates, in batches of up to
+// batchSize metrics and batchDataPoints data points. Each record is sent once, unless a load duration or request count
+// is set, in which case the records are sent over and over until either is reached. It returns the first error of each
+// metric that failed.
+func (s *sender) sendLoad(records []*record) stageErrors {
+	if len(records) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.Background(), func() {}
+	if loadDuration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, loadDuration)
+	}
+	defer cancel()
+
+	stats := newLoadStats()
+	stopReport := stats.startReporting(reportInterval)
+	requestLimiter := newLimiter(requestRate)
+
+	// under load, the rates pace the workers rather than the wait time
+	pause := waitTime
+	if loadDuration > 0 || loadRequests > 0 || requestRate > 0 || dataPointRate > 0 {
+		pause = 0
+	}
+
+	var mu sync.Mutex
+	var errs stageErrors
+	failed := make(map[string]bool)
+	fail := func(r *record, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed[r.Name] {
+			failed[r.Name] = true
+			errs = append(errs, &metricError{r.Name, r.Type, err})
+		}
+	}
+
+	jobs := make(chan *batch)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				// the load duration is over if the wait is cut short
+				if requestLimiter.wait(ctx, 1) != nil {
+					continue
+				}
+
+				start := time.Now()
+				err := s.sendMetrics(b.records, b.metrics)
+				stats.record(b.points, time.Since(start), err)
+				if err != nil {
+					for _, r := range b.records {
+						fail(r, err)
+					}
+				}
+				time.Sleep(pause)
+			}
+		}()
+	}
+
+	produce(ctx, records, jobs, fail)
+	wg.Wait()
+
+	stopReport()
+	return errs
+}
+
+// batch is the metrics of a single request
+type batch struct {
+	records []*record
+	metrics []*metrics.Metric
+	points  int
+	valid   int       // number of metrics the exporter writes to Cortex
+	created time.Time // when the first metric was added
+}
+
+func (b *batch) add(r *record, m *metrics.Metric, points int) {
+	if len(b.metrics) == 0 {
+		b.created = time.Now()
+	}
+	b.records = append(b.records, r)
+	b.metrics = append(b.metrics, m)
+	b.points += points
+	if r.valid() {
+		b.valid++
+	}
+}
+
+// overflows reports whether adding points data points to b would exceed batchDataPoints. A metric with more data
+// points than that is sent on its own.
+func (b *batch) overflows(points int) bool {
+	return len(b.metrics) > 0 && batchDataPoints > 0 && b.points+points > batchDataPoints
+}
+
+// full reports whether b has as many metrics or data points as a request can have. Invalid metrics do not count
+// towards batchSize, so that each is sent in a request with at least one valid metric, which must still be written
+// if the exporter drops the invalid one.
+func (b *batch) full() bool {
+	return b.valid >= batchSize || batchDataPoints > 0 && b.points >= batchDataPoints
+}
+
+// scheduled is a point of a record and the round it is sent in. Round i sends the ith point of every time series.
+type scheduled struct {
+	r     *record
+	point int
+}
+
+// schedule returns every point of records in the order they are sent, and the number of rounds
+func schedule(records []*record) ([]scheduled, int) {
+	rounds := 0
+	for _, r := range records {
+		if n := len(r.points()); n > rounds {
+			rounds = n
+		}
+	}
+	var result []scheduled
+	for i := 0; i < rounds; i++ {
+		for _, r := range records {
+			if i < len(r.points()) {
+				result = append(result, scheduled{r, i})
+			}
+		}
+	}
+	return result, rounds
+}
+
+// produce builds the metric of each point at dataPointRate and passes them to jobs in batches. A batch is passed on
+// when it is full, or flushInterval after its first metric was added if flushInterval is positive. It closes jobs
+// after every point was sent once or, in a load test, when the request count is reached or ctx is done.
+//
+// If records has time series, the ith points are sent pointInterval after the (i-1)th, starting at seriesStart, and
+// points without a timestamp are stamped with the time they are scheduled at.
+func produce(ctx context.Context, records []*record, jobs chan<- *batch, fail func(*record, error)) {
+	defer close(jobs)
+
+	limiter := newLimiter(dataPointRate)
+	repeat := loadDuration > 0 || loadRequests > 0
+	points, rounds := schedule(records)
+	seriesStart = time.Now()
+	round := 0 // rounds are counted on across repeats of the schedule
+	requests := 0
+	b := &batch{}
+	// flush passes b on and returns false if no more requests must be sent
+	flush := func() bool {
+		if len(b.metrics) == 0 {
+			return true
+		}
+		select {
+		case jobs <- b:
+		case <-ctx.Done():
+			return false
+		}
+		b = &batch{}
+		requests++
+		return loadRequests <= 0 || requests < loadRequests
+	}
+
+	for n := 0; repeat || n < len(points); n++ {
+		next := points[n%len(points)]
+		r := next.r.at(next.point)
+		if rounds > 1 {
+			// a new round starts with a new request at its scheduled time
+			if due := n/len(points)*rounds + next.point; due != round {
+				if !flush() || sleepUntil(ctx, seriesStart.Add(time.Duration(due)*pointInterval)) != nil {
+					return
+				}
+				round = due
+			}
+			if r.Timestamp == 0 {
+				r.Timestamp = uint64(seriesStart.Add(time.Duration(round) * pointInterval).UnixNano())
+			}
+		}
+
+		// each scheduled item is a single point of a record, which is built into a metric of one data point
+		if b.overflows(1) && !flush() {
+			return
+		}
+
+		// wait for the data point rate, flushing the batch first if it is due before
+		at := limiter.reserve(1)
+		if flushAt := b.created.Add(flushInterval); len(b.metrics) > 0 && flushInterval > 0 && flushAt.Before(at) {
+			if sleepUntil(ctx, flushAt) != nil || !flush() {
+				return
+			}
+		}
+		if sleepUntil(ctx, at) != nil {
+			return
+		}
+
+		m, err := buildMetric(r)
+		if err != nil {
+			fail(r, err)
+			continue
+		}
+		b.add(r, m, 1)
+		if b.full() && !flush() {
+			return
+		}
+	}
+	flush()
+}
+
+// sleepUntil blocks until t. It returns an error if ctx is done first.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	delay := time.Until(t)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limiter spaces events out evenly to keep to a rate, without bursts. A nil limiter does not limit the rate.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration // time between two events
+	next     time.Time     // earliest time of the next event
+}
+
+// newLimiter returns a limiter of rate events per second, or nil if rate is not positive
+func newLimiter(rate float64) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &limiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// reserve takes n events and returns the time at which they can take place without exceeding the rate
+func (l *limiter) reserve(n int) time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(n) * l.interval)
+	return at
+}
+
+// wait blocks until n events can take place without exceeding the rate. It returns an error if ctx is done first.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	return sleepUntil(ctx, l.reserve(n))
+}
+
+// loadCounters are the totals of a series of requests
+type loadCounters struct {
+	requests   int
+	dataPoints int
+	errors     int
+	latency    time.Duration // total latency of the successful requests
+	maxLatency time.Duration
+}
+
+// format describes c as the result of elapsed time of load
+func (c *loadCounters) format(elapsed time.Duration) string {
+	seconds := elapsed.Seconds()
+	var avgLatency time.Duration
+	if ok := c.requests - c.errors; ok > 0 {
+		avgLatency = c.latency / time.Duration(ok)
+	}
+	return fmt.Sprintf("%d requests (%.1f/s), %d data points (%.1f/s), %d errors, latency avg %v max %v",
+		c.requests, float64(c.requests)/seconds, c.dataPoints, float64(c.dataPoints)/seconds, c.errors,
+		avgLatency.Round(time.Microsecond), c.maxLatency.Round(time.Microsecond))
+}
+
+// loadStats counts the requests of every worker, in total and since the last report
+type loadStats struct {
+	mu            sync.Mutex
+	start         time.Time
+	intervalStart time.Time
+	total         loadCounters
+	interval      loadCounters
+}
+
+func newLoadStats() *loadStats {
+	now := time.Now()
+	return &loadStats{start: now, intervalStart: now}
+}
+
+// record counts a request of dataPoints data points
+func (s *loadStats) record(dataPoints int, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range []*loadCounters{&s.total, &s.interval} {
+		c.requests++
+		if err != nil {
+			c.errors++
+			continue
+		}
+		c.dataPoints += dataPoints
+		c.latency += latency
+		if latency > c.maxLatency {
+			c.maxLatency = latency
+		}
+	}
+}
+
+// startReporting logs the counters of the last interval every interval until the returned function is called, which
+// logs the totals. Nothing is logged during the load if interval is not positive.
+func (s *loadStats) startReporting(interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if interval <= 0 {
+			<-done
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.mu.Lock()
+				now := time.Now()
+				log.Printf("last %v: %s\n", now.Sub(s.intervalStart).Round(time.Millisecond),
+					s.interval.format(now.Sub(s.intervalStart)))
+				s.interval, s.intervalStart = loadCounters{}, now
+				s.mu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		elapsed := time.Since(s.start)
+		log.Printf("sent in %v: %s\n", elapsed.Round(time.Millisecond), s.total.format(elapsed))
+	}
+}
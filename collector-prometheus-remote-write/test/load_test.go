@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadOptions are the options of the sender that shape its requests
+type loadOptions struct {
+	batchSize       int
+	batchDataPoints int
+	flushInterval   time.Duration
+	dataPointRate   float64
+	requests        int
+	pointInterval   time.Duration
+}
+
+// setLoad sets the options of the sender for a test, and returns a function that restores them
+func setLoad(o loadOptions) func() {
+	saved := loadOptions{batchSize, batchDataPoints, flushInterval, dataPointRate, loadRequests, pointInterval}
+	set := func(o loadOptions) {
+		batchSize, batchDataPoints, flushInterval, dataPointRate, loadRequests = o.batchSize, o.batchDataPoints,
+			o.flushInterval, o.dataPointRate, o.requests
+		pointInterval = o.pointInterval
+	}
+	set(o)
+	return func() { set(saved) }
+}
+
+// produceAll runs produce over records and returns the batches it passes on
+func produceAll(t *testing.T, records []*record) []*batch {
+	jobs := make(chan *batch)
+	go produce(context.Background(), records, jobs, func(r *record, err error) {
+		t.Errorf("%s: %v", r.Name, err)
+	})
+	var batches []*batch
+	for b := range jobs {
+		batches = append(batches, b)
+	}
+	return batches
+}
+
+// batchNames returns the names of the metrics of each batch
+func batchNames(batches []*batch) [][]string {
+	var result [][]string
+	for _, b := range batches {
+		var names []string
+		for _, r := range b.records {
+			names = append(names, r.Name)
+		}
+		result = append(result, names)
+	}
+	return result
+}
+
+// gauges returns a single point gauge of each name, and a delta counter, which the exporter drops, of each name
+// starting with "invalid"
+func gauges(names ...string) []*record {
+	var result []*record
+	for _, name := range names {
+		value := 1.0
+		r := &record{Name: name, Type: gauge, Value: &value}
+		if strings.HasPrefix(name, "invalid") {
+			r.Type, r.Temporality = counter, "delta"
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+func Test_produce(t *testing.T) {
+	tests := []struct {
+		name    string
+		options loadOptions
+		records []*record
+		want    [][]string
+	}{
+		{"one_per_request", loadOptions{batchSize: 1}, gauges("a", "b", "c"), [][]string{{"a"}, {"b"}, {"c"}}},
+		{"batch_size", loadOptions{batchSize: 2}, gauges("a", "b", "c", "d", "e"),
+			[][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{"batch_data_points", loadOptions{batchSize: 10, batchDataPoints: 2}, gauges("a", "b", "c", "d", "e"),
+			[][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		// invalid metrics do not count towards the batch size, so each rides with the next valid metric
+		{"invalid_with_next_valid", loadOptions{batchSize: 1}, gauges("a", "invalid1", "b", "invalid2", "invalid3", "c"),
+			[][]string{{"a"}, {"invalid1", "b"}, {"invalid2", "invalid3", "c"}}},
+		{"invalid_last", loadOptions{batchSize: 1}, gauges("a", "invalid1"), [][]string{{"a"}, {"invalid1"}}},
+		{"invalid_batch_data_points", loadOptions{batchSize: 1, batchDataPoints: 2}, gauges("invalid1", "invalid2", "a"),
+			[][]string{{"invalid1", "invalid2"}, {"a"}}},
+		{"requests", loadOptions{batchSize: 1, requests: 5}, gauges("a", "b"),
+			[][]string{{"a"}, {"b"}, {"a"}, {"b"}, {"a"}}},
+		{"requests_batched", loadOptions{batchSize: 2, requests: 2}, gauges("a", "b", "c"),
+			[][]string{{"a", "b"}, {"c", "a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setLoad(tt.options)()
+			if got := batchNames(produceAll(t, tt.records)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_produceFlushInterval(t *testing.T) {
+	// a point every 50ms, and batches that wait 20ms for more metrics
+	defer setLoad(loadOptions{batchSize: 10, dataPointRate: 20})()
+	records := gauges("a", "b", "c")
+	if got, want := batchNames(produceAll(t, records)), [][]string{{"a", "b", "c"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no flush interval: got %v, want %v", got, want)
+	}
+
+	flushInterval = 20 * time.Millisecond
+	batches := produceAll(t, records)
+	if got, want := batchNames(batches), [][]string{{"a"}, {"b"}, {"c"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// the data point rate spaces the batches out
+	for i := 1; i < len(batches); i++ {
+		if gap := batches[i].created.Sub(batches[i-1].created); gap < 40*time.Millisecond {
+			t.Errorf("batch %d created %v after the previous one, want about 50ms", i, gap)
+		}
+	}
+}
+
+func Test_produceRounds(t *testing.T) {
+	defer setLoad(loadOptions{batchSize: 10, pointInterval: 30 * time.Millisecond})()
+	one := 1.0
+	records := []*record{
+		{Name: "a", Type: gauge, Points: []point{{Value: &one}, {Value: &one}, {Value: &one}}},
+		{Name: "b", Type: gauge, Points: []point{{Value: &one}, {Value: &one}}},
+	}
+
+	// each round is a request of the ith point of every series, stamped with the time it is scheduled at
+	batches := produceAll(t, records)
+	if got, want := batchNames(batches), [][]string{{"a", "b"}, {"a", "b"}, {"a"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, b := range batches {
+		due := seriesStart.Add(time.Duration(i) * pointInterval)
+		if b.created.Before(due) {
+			t.Errorf("round %d sent %v early", i, due.Sub(b.created))
+		}
+		for _, r := range b.records {
+			if got := time.Unix(0, int64(r.Timestamp)); !got.Equal(due) {
+				t.Errorf("round %d: %s stamped %v, want %v", i, r.Name, got, due)
+			}
+		}
+	}
+}
+
+func Test_schedule(t *testing.T) {
+	one := 1.0
+	a := &record{Name: "a", Points: []point{{Value: &one}, {Value: &one}, {Value: &one}}}
+	b := &record{Name: "b", Value: &one}
+	got, rounds := schedule([]*record{a, b})
+	want := []scheduled{{a, 0}, {b, 0}, {a, 1}, {a, 2}}
+	if !reflect.DeepEqual(got, want) || rounds != 3 {
+		t.Errorf("got %v in %d rounds, want %v in 3", got, rounds, want)
+	}
+}
+
+func Test_limiter(t *testing.T) {
+	if l := newLimiter(0); l != nil || !l.reserve(5).IsZero() {
+		t.Errorf("got %v, want no limit", l)
+	}
+
+	l := newLimiter(100) // an event every 10ms
+	first := l.reserve(1)
+	if wait := time.Until(first); wait > 0 {
+		t.Errorf("first event waits %v", wait)
+	}
+	if got := l.reserve(3).Sub(first); got != 10*time.Millisecond {
+		t.Errorf("second event: got %v after the first, want 10ms", got)
+	}
+	if got := l.reserve(1).Sub(first); got != 40*time.Millisecond {
+		t.Errorf("after 3 events: got %v after the first, want 40ms", got)
+	}
+
+	// an idle limiter does not save up events for a burst
+	l = newLimiter(100)
+	l.next = time.Now().Add(-time.Second)
+	if wait := time.Until(l.reserve(1)); wait < -10*time.Millisecond {
+		t.Errorf("idle limiter: event reserved %v in the past", -wait)
+	}
+}
+
+func Test_sleepUntil(t *testing.T) {
+	if err := sleepUntil(context.Background(), time.Now().Add(-time.Second)); err != nil {
+		t.Errorf("past time: got %v", err)
+	}
+	start := time.Now()
+	if err := sleepUntil(context.Background(), start.Add(10*time.Millisecond)); err != nil ||
+		time.Since(start) < 10*time.Millisecond {
+		t.Errorf("got %v after %v, want nil after 10ms", err, time.Since(start))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := sleepUntil(ctx, start.Add(time.Minute)); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %v for a canceled context", waited)
+	}
+}
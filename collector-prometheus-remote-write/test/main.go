@@ -1,29 +1,35 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 )
 
 var (
-	cortexEndpoint = "http://aps-workspaces-beta.us-west-2.amazonaws.com" // update this to query a different URL
-	queryPath      = cortexEndpoint + "/workspaces/yang-yu-intern-test-ws/api/v1/query?query="
-	inputPath      = "./test/data.txt" // data file path
-	outputPath     = "./test/ans.txt"
-	item           = 50           // total number of metrics / lines in output file
-	metric         = "metricName" // base metricName. output file has only unique metricName with a number suffix
-	gauge          = "gauge"
-	counter        = "counter"
-	histogram      = "histogram"
-	summary        = "summary"
-	types          = []string{ // types of metrics generatedq
+	// default values of the configurable options below can be overridden with a config file, environment variables or
+	// command-line flags. See config.go
+	cortexEndpoint  = "http://aps-workspaces-beta.us-west-2.amazonaws.com"
+	cortexQueryPath = "/workspaces/yang-yu-intern-test-ws/api/v1/query?query="
+	queryPath       = cortexEndpoint + cortexQueryPath
+	fakeCortexAddr  = ""                  // listen address of the in-memory remote write backend, not started if empty
+	inputPath       = "./test/data.jsonl" // data file path, see datafile.go for the format
+	outputPath      = "./test/ans.jsonl"
+	latencyPath     = ""           // time to visibility of each metric, not written if empty
+	item            = 50           // total number of metrics / lines in output file
+	metric          = "metricName" // base metricName. output file has only unique metricName with a number suffix
+	gauge           = "gauge"
+	counter         = "counter"
+	histogram       = "histogram"
+	summary         = "summary"
+	int64Value      = "int64" // value types of gauges and counters
+	doubleValue     = "double"
+	types           = []string{ // types of metrics generatedq
 		counter,
 		gauge,
 		histogram,
@@ -39,121 +45,227 @@ var (
 	delimeter  = ","                        // separate name, type, labels and metric value
 	space      = " "                        // separate a set of label values or metric values
 	valueBound = 5000                       // metric values are [0, valueBound)
-	bounds     = []float64{0.01, 0.5, 0.99} // fixed quantile/buckets
+	bounds     = []float64{0.01, 0.5, 0.99} // fixed histogram bucket bounds
+	quantiles  = []float64{0.01, 0.5, 0.99} // quantiles of generated summaries, in [0, 1]
+	// generated histograms take turns using these bucket layouts, see parseBucketLayout, or bounds if there are none
+	bucketLayouts = []string{}
+	// each metric is sent by one of these resources, each a set of space-separated attributes
+	resources = []string{
+		"service.name=cortex-exporter-test service.instance.id=host-1:8888 host.name=host-1",
+		"service.name=cortex-exporter-test service.instance.id=host-2:8888 host.name=host-2",
+	}
+	// and is recorded by one of these instrumentation libraries, each a name and an optional version
+	libraries = []string{
+		"cortex-exporter-test 0.1.0",
+		"cortex-exporter-test/load 0.1.0",
+	}
+	resourceLabels = false            // whether the exporter adds the resource attributes to the labels of each time series
+	seriesPoints   = 1                // number of points of each generated time series
+	pointInterval  = 10 * time.Second // time between two points of a time series
+	timestamps     = false            // whether the generator timestamps each point, instead of the sender
+	invalidMetrics = false            // whether the generator adds metrics the exporter must drop to the valid ones
+	dirtyNames     = false            // whether the generator puts characters illegal in Prometheus in metric and label names
+	// and these are the characters; the exporter keeps unicode letters, which Cortex rejects, so only unicode symbols
+	dirtyChars = []string{dirty1, dirty2, ".", "-", "°", "→"}
+
+	endpoint            = "localhost:55680"
+	fakeCollectorAddr   = ""                        // listen address of the in-process OTLP receiver, not started if empty
+	healthCheckEndpoint = "http://localhost:13133/" // health_check extension of the Collector
+	readyTimeout        = 1 * time.Minute           // how long to wait for the Collector to become ready
+	requestTimeout      = 30 * time.Second          // timeout for each gRPC request
+	waitTime            = 1 * time.Second           // wait time between two sends of a worker, ignored under load
+	ingestionTimeout    = 2 * time.Minute           // how long the querier waits for a metric after its last send
+	pollInterval        = 2 * time.Second           // wait time between two queries of a metric that is not visible
+	queryConcurrency    = 16                        // maximum number of queries to Cortex in flight
 
-	endpoint       = "localhost:55680"
-	requestTimeout = 30 * time.Second // timeout for each gRPC request
-	waitTime       = 1 * time.Second  // wait time between two sends
+	collectorConfig = ""                  // Collector config file to read the namespace and const labels of the exporter from
+	namespace       = ""                  // prefix the exporter adds to every metric name
+	constLabels     = map[string]string{} // labels the exporter adds to every time series
+
+	queryRange = false           // query every metric with range queries, writing every returned sample
+	rangeStart = time.Time{}     // start of the range queries, the first point of each metric if zero
+	rangeEnd   = time.Time{}     // end of the range queries, a step after the time of each query if zero
+	rangeStep  = 1 * time.Second // resolution of the range queries
+
+	workers         = 1                // number of goroutines sending requests to the Collector
+	requestRate     = 0.0              // requests per second of all workers, unlimited if 0
+	dataPointRate   = 0.0              // data points per second of all workers, unlimited if 0
+	loadDuration    = time.Duration(0) // send the input file over and over for this long, if positive
+	loadRequests    = 0                // send the input file over and over until this many requests were sent, if positive
+	reportInterval  = 10 * time.Second // interval of the throughput, latency and error counters logged while sending
+	batchSize       = 1                // maximum number of metrics per request
+	batchDataPoints = 0                // maximum number of data points per request, unlimited if 0
+	flushInterval   = time.Duration(0) // maximum time a batch waits for more metrics, unlimited if 0
 
 	bucketStr   = "bucket"
 	quantileStr = "quantile"
 
 	randomSuffix = strconv.Itoa(rand.Intn(5000)) // random suffix to avoid metric name collision between two tests
 	client       http.Client
+	fakeOTLP     *fakeCollector // receives the metrics instead of the Collector if fakeCollectorAddr is set
 
 	awsService = "aps"
 	awsRegion  = "us-west-2"
+
+	queryAuth         = sigv4Auth // authentication of every query: none, basic, bearer, mtls or sigv4, see auth.go
+	basicAuthUsername = ""
+	basicAuthPassword = ""
+	bearerTokenFile   = "" // file holding the bearer token, read for every query so that it can be rotated
+	tlsCAFile         = "" // CA certificate the query endpoint is verified with, the system roots if empty
+	tlsCertFile       = "" // client certificate and key presented to the query endpoint, required by mtls
+	tlsKeyFile        = ""
+	tenantID          = "" // X-Scope-OrgID header of every query for multi-tenant Cortex, not sent if empty
 )
+
 func init() {
 	log.Println("initializing test pipeline...")
 
 	rand.Seed(time.Now().UnixNano())
 	randomSuffix = strconv.Itoa(rand.Intn(5000))
+	log.Println("finished.")
+}
 
-	// attach sig v4 signer for querier
-	interceptor, err := NewAuth(awsService, awsRegion, http.DefaultTransport)
+// initClient attaches the authentication of the queryAuth option and the tenant header to the HTTP client used by the
+// querier
+func initClient() error {
+	transport, err := newQueryTransport()
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
 	client = http.Client{
-		Transport: interceptor,
+		Transport: transport,
 		Timeout:   requestTimeout,
 	}
-	log.Println("finished.")
+	return nil
 }
-func main() {
-	log.Println("waiting for the Collector to start...")
 
-	// wait for collector to start
-	time.Sleep(time.Second * 10)
-	log.Println("generating metrics...")
-	// Writes metrics in the following format to a text file:
-	// 		name, type, label1 labelvalue1 , value1 value2 value3 value4 value5
-	// gauge and counter has only one value
-	generateData()
-	log.Println("finished.")
+// stages maps each command to the test stage it runs. Commands given on the command line are run in order, so stages
+// can be chained, e.g. `send query verify` re-sends an existing data file and checks the result.
+var stages = map[string]func() error{
+	"generate": generateStage,
+	"send":     sendStage,
+	"query":    queryStage,
+	"verify":   verifyStage,
+}
 
-	log.Println("sending metrics...")
-	// send OTLP metrics to the Collector
-	createAndSendLoad()
-	log.Println("finished.")
+// runStages are the stages of the run command, which is the default when no command is given
+var runStages = []string{"generate", "send", "query", "verify"}
 
-	log.Println("querying metrics...")
-	// retrieve and store metrics from Cortex
-	getQueryAndStore(outputPath)
-	log.Println("finished.")
-}
+func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.printConfig {
+		if err := cfg.print(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	cfg.apply()
+
+	if fakeCortexAddr != "" {
+		fc, err := startFakeCortex(fakeCortexAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fc.close()
+		cortexEndpoint = fc.URL()
+		cortexQueryPath = "/api/v1/query?query="
+		queryPath = cortexEndpoint + cortexQueryPath
+		log.Printf("fake Cortex accepting remote writes on %s/api/v1/push\n", cortexEndpoint)
+	}
+	if fakeCollectorAddr != "" {
+		fakeOTLP, err = startFakeCollector(fakeCollectorAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fakeOTLP.close()
+		// the fake receiver has no health_check extension
+		endpoint = fakeOTLP.addr()
+		healthCheckEndpoint = ""
+		log.Printf("fake OTLP receiver listening on %s\n", endpoint)
+	}
 
-// SigningRoundTripper is a Custom RoundTripper that performs AWS Sig V4
-type SigningRoundTripper struct {
-	transport http.RoundTripper
-	signer    *v4.Signer
-	cfg       *aws.Config
-	service   string
+	// a stage that returns stageErrors ran to completion, so the following stages still run; any other error stops
+	// the test
+	var failures []stageFailure
+	for _, name := range cfg.stages() {
+		err := stages[name]()
+		if err == nil {
+			continue
+		}
+		log.Printf("%s failed: %v\n", name, err)
+		failures = append(failures, stageFailure{name, err})
+		var errs stageErrors
+		if !errors.As(err, &errs) {
+			break
+		}
+	}
+	if len(failures) > 0 {
+		reportFailures(failures)
+		os.Exit(1)
+	}
 }
 
-// RoundTrip signs each outgoing request
-func (si *SigningRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+func generateStage() error {
+	log.Println("generating metrics...")
+	// writes a record of each metric to the input file, in the JSON Lines format of datafile.go
+	if err := generateData(); err != nil {
+		return err
+	}
+	log.Println("finished.")
+	return nil
+}
 
-	// Sign the request
-	_, err := si.signer.Sign(req, nil, si.service, *si.cfg.Region, time.Now())
-	if err != nil {
-		return nil, err
+func sendStage() error {
+	log.Println("waiting for the Collector to start...")
+	if err := waitForCollector(); err != nil {
+		return err
 	}
 
-	// Send the request to Cortex
-	resp, err := si.transport.RoundTrip(req)
-	if err != nil {
-		log.Fatal(err)
-		return nil, err
+	log.Println("sending metrics...")
+	// send OTLP metrics to the Collector
+	if err := createAndSendLoad(); err != nil {
+		return err
 	}
+	log.Println("finished.")
 
-	return resp, err
+	if fakeOTLP != nil {
+		log.Println("checking sent metrics...")
+		// compare what the fake receiver got with the input file
+		if err := fakeOTLP.checkReceived(inputPath); err != nil {
+			return err
+		}
+		log.Println("finished.")
+	}
+	return nil
 }
 
-// NewAuth takes a map of strings as parameters and return a http.RoundTripper that perform Sig V4 signing on each
-// request.
-func NewAuth(service, region string, origTransport http.RoundTripper) (http.RoundTripper, error) {
-
-	// Initialize session with default credential chain
-	// https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(region)},
-		aws.NewConfig().WithLogLevel(aws.LogDebugWithSigning),
-	)
-	if err != nil {
-		log.Println(err)
-		return nil, err
+func queryStage() error {
+	if err := initClient(); err != nil {
+		return err
 	}
 
-	if _, err = sess.Config.Credentials.Get(); err != nil {
-		log.Println(err)
-		return nil, err
+	log.Println("querying metrics...")
+	// retrieve and store metrics from Cortex
+	if err := getQueryAndStore(outputPath); err != nil {
+		return err
 	}
+	log.Println("finished.")
+	return nil
+}
 
-	// Get Credentials, either from ./aws or from environmental variables
-	creds := sess.Config.Credentials
-	signer := v4.NewSigner(creds)
-	signer.Debug = aws.LogDebugWithSigning
-	signer.Logger = aws.NewDefaultLogger()
-	rtp := SigningRoundTripper{
-		transport: origTransport,
-		signer:    signer,
-		cfg:       sess.Config,
-		service:   service,
+func verifyStage() error {
+	log.Println("verifying metrics...")
+	// compare the query results with the generated metrics
+	if err := verify(inputPath, outputPath); err != nil {
+		return err
 	}
-	// return a RoundTripper
-	return &rtp, nil
+	log.Println("finished.")
+	return nil
 }
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"log"
-	"os"
-	"strings"
+	"sync"
 	"time"
 
 	service "github.com/open-telemetry/opentelemetry-proto/gen/go/collector/metrics/v1"
@@ -13,89 +11,99 @@ import (
 	"google.golang.org/grpc"
 )
 
+var (
+	// sendTimes records when each metric was last sent by the send stage, by name, to measure how long it takes to
+	// become visible in Cortex. The last point of a time series is sent last.
+	sendTimes   = map[string]time.Time{}
+	sendTimesMu sync.Mutex
+
+	// seriesStart is when the sender scheduled the first point of every time series without timestamps
+	seriesStart time.Time
+)
+
+// recordSendTime records that the metric name was sent now
+func recordSendTime(name string) {
+	sendTimesMu.Lock()
+	defer sendTimesMu.Unlock()
+	sendTimes[name] = time.Now()
+}
+
+// sendTime returns when the metric name was last sent
+func sendTime(name string) (time.Time, bool) {
+	sendTimesMu.Lock()
+	defer sendTimesMu.Unlock()
+	t, ok := sendTimes[name]
+	return t, ok
+}
+
 type sender struct {
 	client service.MetricsServiceClient
 }
 
-func createAndSendLoad() {
+// createAndSendLoad sends every metric of the input file to the Collector. Metrics that cannot be built or sent are
+// returned as stageErrors after the rest of the file has been sent.
+func createAndSendLoad() error {
+	sendTimesMu.Lock()
+	sendTimes = map[string]time.Time{}
+	sendTimesMu.Unlock()
 
 	// connect to the Collector
 	clientConn, err := grpc.Dial(endpoint, grpc.WithInsecure())
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer clientConn.Close()
 	client := service.NewMetricsServiceClient(clientConn)
 	s := &sender{
 		client,
 	}
 	// read from file and send metrics
-	s.createAndSendMetricsFromFile()
+	return s.createAndSendMetricsFromFile()
 }
 
-// createAndSendMetricsFromFile reads a text file, parse each line to build the corresponding otlp metric, then send the
-// metric to the Collector
-func (s *sender) createAndSendMetricsFromFile() {
-	file, err := os.Open(inputPath)
+// createAndSendMetricsFromFile reads the input file, builds the corresponding otlp metric of each record, then sends
+// the metrics to the Collector. See sendLoad for how they are sent.
+func (s *sender) createAndSendMetricsFromFile() error {
+	records, err := readDataFile(inputPath)
 	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return err
 	}
-	// parse each line and build metric
-	for scanner.Scan() {
-		line := strings.Trim(scanner.Text(), space)
-		params := strings.Split(line, delimeter)
 
-		// get metric name and labels
-		name := strings.Trim(params[0], space)
-		labelSet := getLabels(strings.Split(strings.Trim(params[2], space), space)...)
-
-		mType := params[1]
-		values := params[3]
-		var m *metrics.Metric
-		// build metrics
-		switch mType {
-		case gauge, counter:
-			m = buildScalarMetric(name, labelSet, parseNumber(values), intComb)
-		case histogram:
-			m = buildHistogramMetric(name, labelSet, parseuUInt64Slice(values))
-		case summary:
-			m = buildSummaryMetric(name, labelSet, parseFloat64Slice(values))
-		default:
-			log.Println("Invalid metric type")
-			continue
+	var errs stageErrors
+	var valid []*record
+records:
+	for _, r := range records {
+		// the metric of each point of a time series is built when it is sent
+		for i := range r.points() {
+			m, err := buildMetric(r.at(i))
+			if err != nil {
+				errs = append(errs, &metricError{r.Name, r.Type, err})
+				continue records
+			}
+			if i == 0 {
+				log.Printf("%+v\n", m)
+			}
 		}
-		log.Printf("%+v\n", m)
-		s.sendMetric(m)
+		valid = append(valid, r)
 	}
+	errs = append(errs, s.sendLoad(valid)...)
+	return errs.err()
 }
 
-// sendMetric sends m to an endpoint using gRPC protocol. After the request is send, it waits for a while before
-// returning. The timeout for a request is 30 secondes by default
-func (s *sender) sendMetric(m *metrics.Metric) {
+// sendMetrics sends ms, built from records, in a single request to an endpoint using gRPC protocol. The timeout for a
+// request is 30 secondes by default
+func (s *sender) sendMetrics(records []*record, ms []*metrics.Metric) error {
 	// build gRPC request
-	request := service.ExportMetricsServiceRequest{
-		ResourceMetrics: []*metrics.ResourceMetrics{
-			{
-				InstrumentationLibraryMetrics: []*metrics.InstrumentationLibraryMetrics{
-					{
-						Metrics: []*metrics.Metric{
-							m,
-						},
-					},
-				},
-			},
-		},
-	}
+	request := buildRequest(records, ms)
 	// specifc
-	ctx, _ := context.WithTimeout(context.Background(), requestTimeout)
-	_, err := s.client.Export(ctx, &request)
-	time.Sleep(waitTime)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := s.client.Export(ctx, request)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	for _, r := range records {
+		recordSendTime(r.Name)
 	}
+	return nil
 }
@@ -1,215 +1,626 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
 
-func getQueryAndStore(outputPath string) {
+// querySlots limits the number of queries to Cortex in flight to queryConcurrency
+var querySlots chan struct{}
+
+// probe is the polling of a single metric, which has its own ingestion deadline
+type probe struct {
+	deadline time.Time // time after which the querier stops waiting for the metric to become visible in Cortex
+	visible  time.Time // time a query of the metric first returned every time series it waited for
+}
+
+// succeeded records that a query of the metric returned every time series it waited for
+func (p *probe) succeeded() {
+	if p.visible.IsZero() {
+		p.visible = time.Now()
+	}
+}
+
+// timestampMargin is how far around the points of a metric its samples are queried, so that samples written with a
+// slightly wrong timestamp are found as well
+const timestampMargin = 30 * time.Second
+
+// visibility is how long a metric took to become queryable after it was sent
+type visibility struct {
+	name    string
+	mType   string
+	latency time.Duration
+	visible bool
+}
+
+// getQueryAndStore queries every metric of the input file and writes the results to outputPath. Metrics that could
+// not be queried are left out of the output file and returned as stageErrors.
+func getQueryAndStore(outputPath string) error {
 	// check if queryPath is valid
 	url, err := url.ParseRequestURI(queryPath)
 	if err != nil {
-		log.Println("invalid Cortex endpoint")
-		return
+		return fmt.Errorf("invalid Cortex endpoint: %v", err)
+	}
+
+	// read input file to get metric names
+	records, err := readDataFile(inputPath)
+	if err != nil {
+		return err
 	}
 
 	// create output file
-	output, err := os.Create(outputPath)
+	output, err := createDataFile(outputPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer output.Close()
-
-	// open input file to get metric names
-	input, err := os.Open(inputPath)
+	w, err := newDataWriter(output)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer input.Close()
 
-	scanner := bufio.NewScanner(input)
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+	var valid, invalid []*record
+	for _, r := range records {
+		if r.valid() {
+			valid = append(valid, r)
+		} else {
+			invalid = append(invalid, r)
+		}
+	}
+
+	// the valid metrics are queried concurrently, each until ingestionTimeout after it was last sent, so that a slow metric
+	// does not hold up the others. Metrics that were not sent by this process are measured from the start of the query
+	// stage.
+	queryStart := time.Now()
+	querySlots = make(chan struct{}, queryConcurrency)
+	results := make([]*record, len(valid))
+	queryErrs := make([]error, len(valid))
+	visibilities := make([]visibility, len(valid))
+	var wg sync.WaitGroup
+	for i, r := range valid {
+		wg.Add(1)
+		go func(i int, r *record) {
+			defer wg.Done()
+			sent, ok := sendTime(r.Name)
+			if !ok {
+				sent = queryStart
+			}
+			p := &probe{deadline: sent.Add(ingestionTimeout)}
+			results[i], queryErrs[i] = queryMetric(p, url, r)
+			if queryErrs[i] != nil || p.visible.IsZero() {
+				visibilities[i] = visibility{r.Name, r.Type, time.Since(sent), queryErrs[i] == nil}
+				return
+			}
+			visibilities[i] = visibility{r.Name, r.Type, p.visible.Sub(sent), true}
+		}(i, r)
+	}
+	wg.Wait()
+
+	// the results are written in the order of the input file
+	var errs stageErrors
+	for i, r := range valid {
+		if err := queryErrs[i]; err != nil {
+			if name, ok := unprefixedName(url, r); ok {
+				err = fmt.Errorf("%v; found as %s, without the namespace %s", err, name, namespace)
+			}
+			errs = append(errs, &metricError{r.Name, r.Type, err})
+		} else if err := w.write(results[i]); err != nil {
+			return err
+		}
+	}
+
+	// the exporter must drop the invalid metrics, which were sent with the valid ones and are queried once after them;
+	// any that are found are written to the output file for the verifier to report
+	leaked := 0
+	for _, r := range invalid {
+		result, err := queryMetric(&probe{deadline: time.Now()}, url, r)
+		if err != nil {
+			continue
+		}
+		leaked++
+		if err := w.write(result); err != nil {
+			return err
+		}
+	}
+	if len(invalid) > 0 {
+		log.Printf("%d of %d invalid metrics found in Cortex\n", leaked, len(invalid))
+	}
+
+	if err := reportVisibility(visibilities); err != nil {
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	return errs.err()
+}
+
+// unprefixedName returns the name of r without the namespace and whether Cortex has a time series of that name, which
+// the exporter wrote without adding the namespace
+func unprefixedName(queryURL *url.URL, r *record) (string, bool) {
+	if namespace == "" {
+		return "", false
+	}
+	name := prefixedName("", r)
+	series := name
+	if r.Type == histogram || r.Type == summary {
+		series += "_count"
 	}
+	json, err := getJSON(withQuery(queryURL, series, nil))
+	return name, err == nil && len(gjson.Get(json, "data.result").Array()) > 0
+}
 
-	// get query from each line of the input file
-	for scanner.Scan() {
-		line := strings.Trim(scanner.Text(), space)
-		params := strings.Split(line, delimeter)
+// reportVisibility logs the time each metric took to become visible and summary statistics of the ingestion latency,
+// and writes the latencies to latencyPath if it is set
+func reportVisibility(visibilities []visibility) error {
+	var latencies []time.Duration
+	b := &strings.Builder{}
+	for _, v := range visibilities {
+		b.WriteString(v.name)
+		b.WriteString(delimeter)
+		b.WriteString(v.mType)
+		b.WriteString(delimeter)
+		if !v.visible {
+			log.Printf("%s was not visible after %v\n", v.name, v.latency)
+			b.WriteString("not visible\n")
+			continue
+		}
+		latencies = append(latencies, v.latency)
+		b.WriteString(strconv.FormatFloat(v.latency.Seconds(), 'f', 3, 64))
+		b.WriteString("\n")
+	}
 
-		// get metric name, type and labels
-		name := strings.Trim(params[0], space)
-		labelSet := strings.Split(strings.Trim(params[2], space), space)
-		mType := params[1]
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		log.Printf("%d of %d metrics visible, time to visibility: min %v, median %v, max %v\n", len(latencies),
+			len(visibilities), latencies[0], latencies[len(latencies)/2], latencies[len(latencies)-1])
+	} else {
+		log.Printf("0 of %d metrics visible\n", len(visibilities))
+	}
 
-		// query and write metric to output
-		b := &strings.Builder{}
-		queryMetric(url, name, mType, labelSet, b)
-		output.WriteString(b.String())
+	if latencyPath == "" {
+		return nil
 	}
+	return ioutil.WriteFile(latencyPath, []byte(b.String()), 0644)
 }
 
-func queryMetric(url *url.URL, name, mType string, labelSet []string, builder *strings.Builder) {
+// queryMetric queries every time series of the metric r, waiting for each to become visible until the deadline of p,
+// and returns the result
+// as a record. If queryRange is set, the result has every sample of a range query from rangeStart to rangeEnd, and
+// otherwise, if the points of r have timestamps, every sample around them with its timestamp.
+func queryMetric(p *probe, url *url.URL, r *record) (*record, error) {
+	rangeURL := *url
+	if strings.HasSuffix(rangeURL.Path, "/query") {
+		rangeURL.Path += "_range"
+	}
+	if queryRange {
+		start, end := rangeStart, rangeEnd
+		if start.IsZero() {
+			first, err := firstPointTime(r)
+			if err != nil {
+				return nil, fmt.Errorf("%v, set query_start", err)
+			}
+			start = first
+		}
+		if end.IsZero() {
+			// a step later, so that the last step is not before the last sample
+			end = time.Now().Add(rangeStep)
+		}
+		return queryRangeSamples(p, &rangeURL, r, start, end, rangeStep, 1)
+	}
+	if r.timestamped() {
+		return querySamples(p, url, r)
+	}
+	if len(r.Points) > 0 {
+		return querySeries(p, &rangeURL, r)
+	}
+	name := exportedName(r)
+	result := &record{Name: name, Type: r.Type, ValueType: r.ValueType}
 
-	switch mType {
+	switch r.Type {
 	case gauge, counter:
 		// get query result
-		json, err := getJSON(url.String() + name)
+		json, err := pollJSON(p, withQuery(url, name, nil), 1)
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
 
 		// retrieve name and labels
-		name, labels := parseMetric(gjson.Get(json, "data.result.0.metric"))
-		writeQueryNameTypeLabels(name, mType, labels, builder)
+		result.Name, result.Labels = parseMetric(gjson.Get(json, "data.result.0.metric"))
 
 		// retrieve metric value
-		value := gjson.Get(json, "data.result.0.value.1")
-		builder.WriteString(value.Str)
-		builder.WriteString("\n")
+		value := gjson.Get(json, "data.result.0.value.1").Float()
+		result.Value = &value
 	// need to query histogram_sum, histogram_count, and histogram_bucket,
 	case histogram:
 		// retrieve histogram_sum time series
-		jsonSum, err := getJSON(url.String() + name + "_sum")
+		jsonSum, err := pollJSON(p, withQuery(url, name+"_sum", nil), 1)
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
 
-		// retrieve name and labels of this metric
-		_, labels := parseMetric(gjson.Get(jsonSum, "data.result.0.metric"))
-		writeQueryNameTypeLabels(name, mType, labels, builder)
-
-		// retrieve sum value
-		value := gjson.Get(jsonSum, "data.result.0.value.1")
-		builder.WriteString(value.Str)
-		builder.WriteString(space)
+		// retrieve labels and sum value of this metric
+		_, result.Labels = parseMetric(gjson.Get(jsonSum, "data.result.0.metric"))
+		result.Sum = gjson.Get(jsonSum, "data.result.0.value.1").Float()
 
 		// retrieve histogram_count time series
-		jsonCount, err := getJSON(url.String() + name + "_count")
+		jsonCount, err := pollJSON(p, withQuery(url, name+"_count", nil), 1)
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
 		// retrieve count value
-		value = gjson.Get(jsonCount, "data.result.0.value.1")
-		builder.WriteString(value.Str)
-		builder.WriteString(space)
+		result.Count = gjson.Get(jsonCount, "data.result.0.value.1").Uint()
 
-		// retrieve the buckets JSON
-		jsonBuckets, err := getJSON(url.String() + name + "_bucket")
+		// retrieve the buckets JSON, one series for each bound and one for +Inf
+		jsonBuckets, err := pollPartialJSON(p, withQuery(url, name+"_"+bucketStr, nil), len(r.Bounds)+1)
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
 
-		// iterate through the results object, which contains objects for each bucket
-		results := gjson.Get(jsonBuckets, "data.result")
-		results.ForEach(func(key, value gjson.Result) bool {
-			bucketValue := gjson.Parse(value.String()).Get("value.1")
-			metricBoundary := gjson.Parse(value.String()).Get("metric.le").String()
-			if metricBoundary != "+Inf" {
-				builder.WriteString(bucketValue.Str)
-				builder.WriteString(space)
+		// the buckets are sorted by bound, with the +Inf bucket last
+		buckets := gjson.Get(jsonBuckets, "data.result").Array()
+		les, err := sortByLabel(buckets, "le")
+		if err != nil {
+			return nil, err
+		}
+		for i, b := range buckets {
+			if !math.IsInf(les[i], 1) {
+				result.Bounds = append(result.Bounds, les[i])
 			}
-			return true
-		})
-		builder.WriteString("\n")
+			result.Buckets = append(result.Buckets, b.Get("value.1").Uint())
+		}
 	// need to query summary_sum, summary_count, and summary quantiles,
 	case summary:
 		// retrieve summary_sum time series
-		jsonSum, err := getJSON(url.String() + name + "_sum")
+		jsonSum, err := pollJSON(p, withQuery(url, name+"_sum", nil), 1)
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
 
-		// retrieve name and labels of this metric
-		_, labels := parseMetric(gjson.Get(jsonSum, "data.result.0.metric"))
-		writeQueryNameTypeLabels(name, mType, labels, builder)
-
-		// retrieve sum value
-		value := gjson.Get(jsonSum, "data.result.0.value.1")
-		builder.WriteString(value.Str)
-		builder.WriteString(space)
+		// retrieve labels and sum value of this metric
+		_, result.Labels = parseMetric(gjson.Get(jsonSum, "data.result.0.metric"))
+		result.Sum = gjson.Get(jsonSum, "data.result.0.value.1").Float()
 
 		// retrieve summary_count time series
-		jsonCount, err := getJSON(url.String() + name + "_count")
+		jsonCount, err := pollJSON(p, withQuery(url, name+"_count", nil), 1)
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
 		// retrieve count value
-		value = gjson.Get(jsonCount, "data.result.0.value.1")
-		builder.WriteString(value.Str)
-		builder.WriteString(space)
+		result.Count = gjson.Get(jsonCount, "data.result.0.value.1").Uint()
 
 		// retrieve the quantiles JSON
-		jsonBuckets, err := getJSON(url.String() + name)
+		jsonQuantiles, err := pollPartialJSON(p, withQuery(url, name, nil), len(r.Quantiles))
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
 
-		// iterate through the results object, which contains objects for each quantile
-		results := gjson.Get(jsonBuckets, "data.result")
-		results.ForEach(func(key, value gjson.Result) bool {
-			quantileValue := gjson.Parse(value.String()).Get("value.1")
-			// need to add extra 0 to the end for numbers with less than 6 decimal place
-			num, _ := strconv.ParseFloat(quantileValue.Str, 64)
-			builder.WriteString(fmt.Sprintf("%f", num))
-			builder.WriteString(space)
-			return true
-		})
-		builder.WriteString("\n")
+		// the quantiles are sorted
+		quantiles := gjson.Get(jsonQuantiles, "data.result").Array()
+		qs, err := sortByLabel(quantiles, quantileStr)
+		if err != nil {
+			return nil, err
+		}
+		for i, q := range quantiles {
+			result.Quantiles = append(result.Quantiles, quantile{Quantile: qs[i], Value: q.Get("value.1").Float()})
+		}
 	}
+	return result, nil
+}
 
+// querySeries queries every point of the time series r with range queries on rangeURL. The queries are evaluated
+// halfway between two points, so that each step returns a single point.
+func querySeries(p *probe, rangeURL *url.URL, r *record) (*record, error) {
+	first, err := firstPointTime(r)
+	if err != nil {
+		return nil, err
+	}
+	n := len(r.Points)
+	start := first.Add(pointInterval / 2)
+	return queryRangeSamples(p, rangeURL, r, start, start.Add(time.Duration(n-1)*pointInterval), pointInterval, n)
 }
 
-func writeQueryNameTypeLabels(name, mType string, labels map[string]string, builder *strings.Builder) {
-	// write name and type
-	builder.WriteString(name)
-	builder.WriteString(delimeter)
-	builder.WriteString(mType)
-	builder.WriteString(delimeter)
-	// store keys and sort by keys so that output has the same order as input
-	keys := make([]string, 0, len(labels))
+// firstPointTime returns the timestamp of the first point of r, or the time the sender started sending if it has none
+func firstPointTime(r *record) (time.Time, error) {
+	if ts := r.points()[0].Timestamp; ts != 0 {
+		return time.Unix(0, int64(ts)), nil
+	}
+	if seriesStart.IsZero() {
+		return time.Time{}, fmt.Errorf("the points have no timestamps and were not sent by this run")
+	}
+	return seriesStart, nil
+}
 
-	for k := range labels {
-		keys = append(keys, k)
+// queryRangeSamples queries the metric r with range queries on rangeURL from start to end, waiting for every time
+// series to have at least minValues samples. The result has a point for each evaluation time, with the time as its
+// timestamp.
+func queryRangeSamples(p *probe, rangeURL *url.URL, r *record, start, end time.Time, step time.Duration, minValues int) (*record, error) {
+	params := url.Values{
+		"start": {formatQueryTime(start)},
+		"end":   {formatQueryTime(end)},
+		"step":  {strconv.FormatFloat(step.Seconds(), 'f', -1, 64)},
 	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		builder.WriteString(k)
-		builder.WriteString(space)
-		builder.WriteString(labels[k])
-		builder.WriteString(space)
+	return queryMatrix(r, func(name string, minSeries int) (string, error) {
+		return pollRange(p, withQuery(rangeURL, name, params), minSeries, minValues)
+	})
+}
+
+// querySamples queries the samples of the metric r from timestampMargin before its first point to timestampMargin
+// after its last one, with instant queries of range selectors. Unlike the result of a range query, each sample has its
+// own timestamp, which is only rounded to milliseconds.
+func querySamples(p *probe, queryURL *url.URL, r *record) (*record, error) {
+	points := r.points()
+	first := time.Unix(0, int64(points[0].Timestamp)).Add(-timestampMargin)
+	last := time.Unix(0, int64(points[len(points)-1].Timestamp)).Add(timestampMargin)
+	window := strconv.FormatInt(int64(last.Sub(first)/time.Millisecond), 10) + "ms"
+	return queryMatrix(r, func(name string, minSeries int) (string, error) {
+		query := withQuery(queryURL, name+"["+window+"]", url.Values{"time": {formatQueryTime(last)}})
+		return pollRange(p, query, minSeries, len(points))
+	})
+}
+
+// withQuery returns the URL of the query expr on the query API at base, with the other parameters params. The query
+// parameter that query_path ends with is replaced by expr.
+func withQuery(base *url.URL, expr string, params url.Values) string {
+	u := *base
+	values := u.Query()
+	values.Set("query", expr)
+	for k, v := range params {
+		values[k] = v
 	}
-	builder.WriteString(delimeter)
+	u.RawQuery = values.Encode()
+	return u.String()
+}
+
+// queryMatrix builds the result of the metric r from the matrix results returned by query for each of its series
+// names, with a point for each sample. query returns the response to a query of name once it has at least minSeries
+// series.
+func queryMatrix(r *record, query func(name string, minSeries int) (string, error)) (*record, error) {
+	fetch := func(name string, minSeries int) ([]gjson.Result, error) {
+		json, err := query(name, minSeries)
+		if err != nil {
+			return nil, err
+		}
+		return gjson.Get(json, "data.result").Array(), nil
+	}
+
+	// fetchPartial fetches at least one series of name if fewer than minSeries become visible, for the verifier to report
+	// which are missing
+	fetchPartial := func(name string, minSeries int) ([]gjson.Result, error) {
+		result, err := fetch(name, minSeries)
+		if err != nil {
+			result, err = fetch(name, 1)
+		}
+		return result, err
+	}
+
+	// the points are the samples of the first series, and the samples of the other series of the metric are matched to
+	// them by timestamp
+	name := exportedName(r)
+	result := &record{Name: name, Type: r.Type, ValueType: r.ValueType}
+	index := make(map[float64]int)
+	setPoints := func(series gjson.Result) {
+		for _, v := range series.Get("values").Array() {
+			seconds := v.Get("0").Float()
+			index[seconds] = len(result.Points)
+			ts := uint64(math.Round(seconds*1000)) * uint64(time.Millisecond)
+			result.Points = append(result.Points, point{Timestamp: ts})
+		}
+	}
+	// each calls f with the point and value of each sample of series
+	each := func(series gjson.Result, f func(p *point, value gjson.Result)) error {
+		values := series.Get("values").Array()
+		if len(values) != len(result.Points) {
+			return fmt.Errorf("%s has %d samples, expected %d", seriesName(series), len(values), len(result.Points))
+		}
+		for _, v := range values {
+			i, ok := index[v.Get("0").Float()]
+			if !ok {
+				return fmt.Errorf("%s has a sample at %s that the other series of the metric have not",
+					seriesName(series), v.Get("0").Raw)
+			}
+			f(&result.Points[i], v.Get("1"))
+		}
+		return nil
+	}
+
+	switch r.Type {
+	case gauge, counter:
+		values, err := fetch(name, 1)
+		if err != nil {
+			return nil, err
+		}
+		result.Name, result.Labels = parseMetric(values[0].Get("metric"))
+		setPoints(values[0])
+		if err := each(values[0], func(p *point, v gjson.Result) {
+			value := v.Float()
+			p.Value = &value
+		}); err != nil {
+			return nil, err
+		}
+	case histogram, summary:
+		sum, err := fetch(name+"_sum", 1)
+		if err != nil {
+			return nil, err
+		}
+		_, result.Labels = parseMetric(sum[0].Get("metric"))
+		setPoints(sum[0])
+		if err := each(sum[0], func(p *point, v gjson.Result) { p.Sum = v.Float() }); err != nil {
+			return nil, err
+		}
+		count, err := fetch(name+"_count", 1)
+		if err != nil {
+			return nil, err
+		}
+		if err := each(count[0], func(p *point, v gjson.Result) { p.Count = v.Uint() }); err != nil {
+			return nil, err
+		}
+
+		if r.Type == histogram {
+			// one series for each bound and one for +Inf, sorted by bound with the +Inf bucket last
+			buckets, err := fetchPartial(name+"_"+bucketStr, len(r.Bounds)+1)
+			if err != nil {
+				return nil, err
+			}
+			les, err := sortByLabel(buckets, "le")
+			if err != nil {
+				return nil, err
+			}
+			for i, s := range buckets {
+				if !math.IsInf(les[i], 1) {
+					result.Bounds = append(result.Bounds, les[i])
+				}
+				if err := each(s, func(p *point, v gjson.Result) { p.Buckets = append(p.Buckets, v.Uint()) }); err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
+		quantiles, err := fetchPartial(name, len(r.points()[0].Quantiles))
+		if err != nil {
+			return nil, err
+		}
+		qs, err := sortByLabel(quantiles, quantileStr)
+		if err != nil {
+			return nil, err
+		}
+		for i, s := range quantiles {
+			q := qs[i]
+			if err := each(s, func(p *point, v gjson.Result) {
+				p.Quantiles = append(p.Quantiles, quantile{Quantile: q, Value: v.Float()})
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// seriesName formats the name and labels of a series of a query result
+func seriesName(series gjson.Result) string {
+	name, labels := parseMetric(series.Get("metric"))
+	return name + fmt.Sprint(labels)
+}
+
+// pollRange repeats a range query until the result contains at least minSeries time series with at least minValues
+// values each, or until the deadline of p
+func pollRange(p *probe, url string, minSeries, minValues int) (string, error) {
+	for {
+		json, err := getJSON(url)
+		series := gjson.Get(json, "data.result").Array()
+		complete := 0
+		for _, s := range series {
+			if len(s.Get("values").Array()) >= minValues {
+				complete++
+			}
+		}
+		if err == nil && complete >= minSeries && complete == len(series) {
+			p.succeeded()
+			return json, nil
+		}
+		if time.Now().Add(pollInterval).After(p.deadline) {
+			if err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("%d of %d time series with all %d points visible before the ingestion deadline",
+				complete, minSeries, minValues)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// formatQueryTime formats t in unix seconds for the query API
+func formatQueryTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', 3, 64)
+}
+
+// pollJSON queries Cortex until the result contains at least minResults time series. If that does not happen before
+// the deadline of p, it returns an error; every query is attempted at least once.
+func pollJSON(p *probe, url string, minResults int) (string, error) {
+	for {
+		json, err := getJSON(url)
+		results := len(gjson.Get(json, "data.result").Array())
+		if err == nil && results >= minResults {
+			p.succeeded()
+			return json, nil
+		}
+		if time.Now().Add(pollInterval).After(p.deadline) {
+			if err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("%d of %d time series visible before the ingestion deadline", results, minResults)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// pollPartialJSON is pollJSON, except that a result with fewer than minResults time series is returned if it has any, for
+// the verifier to report which are missing
+func pollPartialJSON(p *probe, url string, minResults int) (string, error) {
+	json, err := pollJSON(p, url, minResults)
+	if err != nil {
+		// the deadline has passed, so that this is a single query
+		json, err = pollJSON(p, url, 1)
+	}
+	return json, err
+}
+
+// sortByLabel sorts series, the time series of a query result, by the number in their label name, like le or quantile,
+// and returns the sorted numbers. +Inf sorts last.
+func sortByLabel(series []gjson.Result, name string) ([]float64, error) {
+	numbers := make([]float64, len(series))
+	for i, s := range series {
+		label := s.Get("metric." + name).String()
+		n, err := strconv.ParseFloat(label, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label %q: %v", name, label, err)
+		}
+		numbers[i] = n
+	}
+	sort.Sort(&seriesByNumber{series, numbers})
+	return numbers, nil
+}
+
+// seriesByNumber sorts time series by a number of each
+type seriesByNumber struct {
+	series  []gjson.Result
+	numbers []float64
+}
+
+func (s *seriesByNumber) Len() int           { return len(s.series) }
+func (s *seriesByNumber) Less(i, j int) bool { return s.numbers[i] < s.numbers[j] }
+func (s *seriesByNumber) Swap(i, j int) {
+	s.series[i], s.series[j] = s.series[j], s.series[i]
+	s.numbers[i], s.numbers[j] = s.numbers[j], s.numbers[i]
 }
 
 // getJSON makes a HTTP GET request to Cortex and returns a JSON as a string.
 func getJSON(url string) (string, error) {
+	if querySlots != nil {
+		querySlots <- struct{}{}
+		defer func() { <-querySlots }()
+	}
 
 	res, err := client.Get(url)
 	if err != nil {
-		log.Printf("error querying this URL: %v\n", url)
 		return "", err
 	}
 	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
 		return "", fmt.Errorf("non-200 status code: %v", res.StatusCode)
 	}
+	defer res.Body.Close()
 
 	// Convert the response body into a JSON string.
 	body, err := ioutil.ReadAll(res.Body)
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func Test_withQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   string
+		expr   string
+		params url.Values
+		want   string
+	}{
+		{"query_path", "http://cortex/api/v1/query?query=", "metric_total", nil,
+			"http://cortex/api/v1/query?query=metric_total"},
+		{"escaped", "http://cortex/api/v1/query?query=", `metric{le="+Inf"}[60000ms]`, url.Values{"time": {"1.5"}},
+			"http://cortex/api/v1/query?query=metric%7Ble%3D%22%2BInf%22%7D%5B60000ms%5D&time=1.5"},
+		{"no_query_parameter", "http://cortex/api/v1/query_range", "a&b", url.Values{"step": {"5"}},
+			"http://cortex/api/v1/query_range?query=a%26b&step=5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := url.Parse(tt.base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := withQuery(base, tt.expr, tt.params); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if base.String() != tt.base {
+				t.Errorf("base changed to %s", base)
+			}
+		})
+	}
+}
+
+// vectorResult returns the body of an instant query result of n time series
+func vectorResult(n int) string {
+	var series []string
+	for i := 0; i < n; i++ {
+		series = append(series, fmt.Sprintf(`{"metric":{"__name__":"m","i":"%d"},"value":[1,"1"]}`, i))
+	}
+	return `{"status":"success","data":{"resultType":"vector","result":[` + strings.Join(series, ",") + `]}}`
+}
+
+// matrixResult returns the body of a range query result of a time series with each number of values
+func matrixResult(values ...int) string {
+	var series []string
+	for i, n := range values {
+		var samples []string
+		for j := 0; j < n; j++ {
+			samples = append(samples, fmt.Sprintf(`[%d,"1"]`, j+1))
+		}
+		series = append(series, fmt.Sprintf(`{"metric":{"__name__":"m","i":"%d"},"values":[%s]}`, i,
+			strings.Join(samples, ",")))
+	}
+	return `{"status":"success","data":{"resultType":"matrix","result":[` + strings.Join(series, ",") + `]}}`
+}
+
+// resultServer serves the body returned by result for each query, counting from 1, or a 500 if it is empty
+func resultServer(result func(query int32) string) (*httptest.Server, *int32) {
+	var queries int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := result(atomic.AddInt32(&queries, 1))
+		if body == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(w, body)
+	})), &queries
+}
+
+func Test_pollQueries(t *testing.T) {
+	saved := pollInterval
+	defer func() { pollInterval = saved }()
+	pollInterval = 5 * time.Millisecond
+
+	pollVector := func(p *probe, url string) (string, error) { return pollJSON(p, url, 2) }
+	pollPartial := func(p *probe, url string) (string, error) { return pollPartialJSON(p, url, 2) }
+	pollMatrix := func(p *probe, url string) (string, error) { return pollRange(p, url, 2, 2) }
+	tests := []struct {
+		name        string
+		poll        func(p *probe, url string) (string, error)
+		result      func(query int32) string
+		deadline    time.Duration
+		wantQueries int32 // -1 for any number
+		wantSeries  int
+		wantErr     string
+	}{
+		{"visible", pollVector, func(int32) string { return vectorResult(3) }, time.Second, 1, 3, ""},
+		{"becomes_visible", pollVector, func(q int32) string { return vectorResult(int(q) - 1) }, time.Second, 3, 2, ""},
+		{"recovers", pollVector, func(q int32) string {
+			if q == 1 {
+				return ""
+			}
+			return vectorResult(2)
+		}, time.Second, 2, 2, ""},
+		{"deadline", pollVector, func(int32) string { return vectorResult(1) }, 50 * time.Millisecond, -1, 0,
+			"1 of 2 time series visible before the ingestion deadline"},
+		{"error", pollVector, func(int32) string { return "" }, 50 * time.Millisecond, -1, 0,
+			"non-200 status code: 500"},
+		{"past_deadline", pollVector, func(int32) string { return vectorResult(0) }, -time.Second, 1, 0,
+			"0 of 2 time series visible"},
+		{"partial", pollPartial, func(int32) string { return vectorResult(1) }, 50 * time.Millisecond, -1, 1, ""},
+		{"partial_none", pollPartial, func(int32) string { return vectorResult(0) }, 50 * time.Millisecond, -1, 0,
+			"0 of 1 time series visible"},
+		{"range", pollMatrix, func(q int32) string { return matrixResult(int(q), 2) }, time.Second, 2, 2, ""},
+		// each series must have every point
+		{"range_points", pollMatrix, func(int32) string { return matrixResult(1, 2) }, 50 * time.Millisecond, -1, 0,
+			"1 of 2 time series with all 2 points visible before the ingestion deadline"},
+		{"range_series", pollMatrix, func(int32) string { return matrixResult(2) }, 50 * time.Millisecond, -1, 0,
+			"1 of 2 time series with all 2 points visible"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, queries := resultServer(tt.result)
+			defer server.Close()
+
+			p := &probe{deadline: time.Now().Add(tt.deadline)}
+			json, err := tt.poll(p, server.URL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				if !p.visible.IsZero() {
+					t.Errorf("visible at %v after an error", p.visible)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := len(gjson.Get(json, "data.result").Array()); got != tt.wantSeries {
+					t.Errorf("got %d time series, want %d", got, tt.wantSeries)
+				}
+				if p.visible.IsZero() {
+					t.Error("visible time not set")
+				}
+			}
+			if tt.wantQueries >= 0 && atomic.LoadInt32(queries) != tt.wantQueries {
+				t.Errorf("got %d queries, want %d", atomic.LoadInt32(queries), tt.wantQueries)
+			}
+		})
+	}
+}
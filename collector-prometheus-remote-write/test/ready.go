@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+var (
+	initialBackoff = 100 * time.Millisecond // wait time after the first failed probe, doubled after each failure
+	maxBackoff     = 5 * time.Second
+)
+
+// waitForCollector blocks until the health_check extension of the Collector reports it is ready and its OTLP receiver
+// accepts gRPC connections. Both are polled with exponential backoff until readyTimeout elapses. The health check is
+// skipped if healthCheckEndpoint is empty.
+func waitForCollector() error {
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+
+	if healthCheckEndpoint != "" {
+		if err := poll(ctx, "health check "+healthCheckEndpoint, checkHealth); err != nil {
+			return err
+		}
+	}
+	return poll(ctx, "OTLP receiver "+endpoint, checkGRPC)
+}
+
+// poll calls probe until it succeeds or ctx is done. The returned error contains the error of the last attempt.
+func poll(ctx context.Context, name string, probe func(context.Context) error) error {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := probe(ctx)
+		if err == nil {
+			log.Printf("%s is ready after %d attempt(s)\n", name, attempt)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s is not ready after %d attempt(s) in %v, last error: %v", name, attempt, readyTimeout, err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// checkHealth returns nil if the health_check extension responds with 200 OK
+func checkHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, healthCheckEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-200 status code: %v", res.StatusCode)
+	}
+	return nil
+}
+
+// checkGRPC returns nil if a gRPC connection to the OTLP receiver can be established
+func checkGRPC(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	// fail on the first non-temporary error, such as connection refused, instead of retrying until ctx is done
+	conn, err := grpc.DialContext(ctx, endpoint, grpc.WithInsecure(), grpc.WithBlock(), grpc.FailOnNonTempDialError(true))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
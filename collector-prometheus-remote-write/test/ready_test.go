@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// unhealthyServer serves a health check that fails the first failures times
+func unhealthyServer(failures int32) (*httptest.Server, *int32) {
+	var calls int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})), &calls
+}
+
+func Test_waitForCollector(t *testing.T) {
+	c, err := startFakeCollector("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	// an address nothing listens on
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	savedEndpoint, savedHealth, savedTimeout := endpoint, healthCheckEndpoint, readyTimeout
+	savedInitial, savedMax := initialBackoff, maxBackoff
+	defer func() {
+		endpoint, healthCheckEndpoint, readyTimeout = savedEndpoint, savedHealth, savedTimeout
+		initialBackoff, maxBackoff = savedInitial, savedMax
+	}()
+	readyTimeout, initialBackoff, maxBackoff = 500*time.Millisecond, 5*time.Millisecond, 20*time.Millisecond
+
+	tests := []struct {
+		name      string
+		failures  int32 // of the health check, -1 to skip it
+		endpoint  string
+		wantCalls int32 // of the health check, -1 for any number
+		wantErr   []string
+	}{
+		{"ready", 0, c.addr(), 1, nil},
+		{"becomes_ready", 3, c.addr(), 4, nil},
+		{"no_health_check", -1, c.addr(), 0, nil},
+		{"unhealthy", 1000, c.addr(), -1,
+			[]string{"health check http://", "is not ready after", "non-200 status code: 503"}},
+		{"no_receiver", 0, closed, 1, []string{"OTLP receiver " + closed + " is not ready after"}},
+		{"no_receiver_without_health_check", -1, closed, 0, []string{"OTLP receiver " + closed + " is not ready after"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, calls := unhealthyServer(tt.failures)
+			defer server.Close()
+			healthCheckEndpoint, endpoint = server.URL, tt.endpoint
+			if tt.failures < 0 {
+				healthCheckEndpoint = ""
+			}
+
+			start := time.Now()
+			err := waitForCollector()
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Fatalf("got %v", err)
+			}
+			for _, want := range tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("got %v, want an error containing %q", err, want)
+				}
+			}
+			if tt.wantErr != nil && time.Since(start) < readyTimeout {
+				t.Errorf("gave up after %v, before the ready timeout", time.Since(start))
+			}
+			if tt.wantCalls >= 0 && atomic.LoadInt32(calls) != tt.wantCalls {
+				t.Errorf("health check called %d times, want %d", atomic.LoadInt32(calls), tt.wantCalls)
+			}
+		})
+	}
+}
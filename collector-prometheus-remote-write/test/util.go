@@ -1,13 +1,19 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
+	service "github.com/open-telemetry/opentelemetry-proto/gen/go/collector/metrics/v1"
 	common "github.com/open-telemetry/opentelemetry-proto/gen/go/common/v1"
 	metrics "github.com/open-telemetry/opentelemetry-proto/gen/go/metrics/v1"
 	otlp "github.com/open-telemetry/opentelemetry-proto/gen/go/metrics/v1"
+	resource "github.com/open-telemetry/opentelemetry-proto/gen/go/resource/v1"
 )
 
 type combination struct {
@@ -56,6 +62,7 @@ var (
 	monotonicInt64Comb  = 0
 	monotonicDoubleComb = 1
 	intComb             = 4
+	doubleComb          = 5
 	histogramComb       = 2
 	summaryComb         = 3
 	validCombinations   = []combination{
@@ -75,21 +82,17 @@ var (
 		{otlp.MetricDescriptor_MONOTONIC_DOUBLE, otlp.MetricDescriptor_DELTA},
 		{otlp.MetricDescriptor_HISTOGRAM, otlp.MetricDescriptor_DELTA},
 		{otlp.MetricDescriptor_SUMMARY, otlp.MetricDescriptor_DELTA},
-		{otlp.MetricDescriptor_MONOTONIC_INT64, otlp.MetricDescriptor_DELTA},
-		{otlp.MetricDescriptor_MONOTONIC_DOUBLE, otlp.MetricDescriptor_DELTA},
-		{otlp.MetricDescriptor_HISTOGRAM, otlp.MetricDescriptor_DELTA},
-		{otlp.MetricDescriptor_SUMMARY, otlp.MetricDescriptor_DELTA},
-		{ty: otlp.MetricDescriptor_INVALID_TYPE},
-		{temp: otlp.MetricDescriptor_INVALID_TEMPORALITY},
-		{},
+		{otlp.MetricDescriptor_INVALID_TYPE, otlp.MetricDescriptor_CUMULATIVE},
+		{otlp.MetricDescriptor_MONOTONIC_INT64, otlp.MetricDescriptor_INVALID_TEMPORALITY},
+		{}, // the type and temporality of an empty descriptor
 	}
 )
 
 // OTLP metrics
-// labels must come in pairs
+// labels must come in pairs; an unpaired last label is ignored
 func getLabels(labels ...string) []*common.StringKeyValue {
 	var set []*common.StringKeyValue
-	for i := 0; i < len(labels); i += 2 {
+	for i := 0; i+1 < len(labels); i += 2 {
 		set = append(set, &common.StringKeyValue{
 			Key:   labels[i],
 			Value: labels[i+1],
@@ -117,6 +120,15 @@ func getIntDataPoint(labels []*common.StringKeyValue, value int64, ts uint64) *o
 	}
 }
 
+func getDoubleDataPoint(labels []*common.StringKeyValue, value float64, ts uint64) *otlp.DoubleDataPoint {
+	return &otlp.DoubleDataPoint{
+		Labels:            labels,
+		StartTimeUnixNano: 0,
+		TimeUnixNano:      ts,
+		Value:             value,
+	}
+}
+
 func getHistogramDataPoint(labels []*common.StringKeyValue, ts uint64, sum float64, count uint64, bounds []float64, buckets []uint64) *otlp.HistogramDataPoint {
 	bks := []*otlp.HistogramDataPoint_Bucket{}
 	for _, c := range buckets {
@@ -153,66 +165,383 @@ func getSummaryDataPoint(labels []*common.StringKeyValue, ts uint64, sum float64
 		PercentileValues:  pcs,
 	}
 }
-func buildScalarMetric(name string, labels []*common.StringKeyValue, val float64, kind int) *metrics.Metric {
+
+// buildMetric builds the OTLP metric described by r. Points without a timestamp are stamped with the current time.
+func buildMetric(r *record) (*metrics.Metric, error) {
+	comb, err := metricCombination(r)
+	if err != nil {
+		return nil, err
+	}
+	labelSet := getLabels(labelPairs(r.Labels)...)
+	ts := r.Timestamp
+	if ts == 0 {
+		ts = uint64(time.Now().UnixNano())
+	}
+
+	var m *metrics.Metric
+	switch r.Type {
+	case gauge, counter:
+		if r.Value == nil {
+			return nil, fmt.Errorf("%s %s has no value", r.Type, r.Name)
+		}
+		if r.ValueType == doubleValue {
+			m = buildDoubleMetric(r.Name, labelSet, *r.Value, doubleComb, ts)
+			break
+		}
+		if *r.Value != math.Trunc(*r.Value) {
+			return nil, fmt.Errorf("value %v of %s %s is not an integer", *r.Value, r.Type, r.Name)
+		}
+		m = buildScalarMetric(r.Name, labelSet, *r.Value, intComb, ts)
+	case histogram:
+		m = buildHistogramMetric(r.Name, labelSet, ts, r.Sum, r.Count, r.Bounds, r.Buckets)
+	case summary:
+		pcts := make([]float64, len(r.Quantiles))
+		values := make([]float64, len(r.Quantiles))
+		for i, q := range r.Quantiles {
+			pcts[i] = q.Quantile
+			values[i] = q.Value
+		}
+		m = buildSummaryMetric(r.Name, labelSet, ts, r.Sum, r.Count, pcts, values)
+	default:
+		return nil, fmt.Errorf("invalid metric type %q", r.Type)
+	}
+	m.MetricDescriptor.Type, m.MetricDescriptor.Temporality = comb.ty, comb.temp
+	m.MetricDescriptor.Description = r.Description
+	m.MetricDescriptor.Unit = r.Unit
+	if r.NoDescriptor {
+		m.MetricDescriptor = nil
+	}
+	return m, nil
+}
+
+// metricCombination returns the OTLP type and temporality of the metric built from r. Gauges are INT64 or DOUBLE and
+// counters MONOTONIC_INT64 or MONOTONIC_DOUBLE depending on the value type of r, which defaults to int64, unless r has
+// another OTLP type, and every metric is cumulative unless r has another temporality. The combination may be one of
+// the invalidCombinations.
+func metricCombination(r *record) (combination, error) {
+	var c combination
+	double := false
+	switch r.ValueType {
+	case "", int64Value:
+	case doubleValue:
+		double = true
+	default:
+		return c, fmt.Errorf("invalid value type %q", r.ValueType)
+	}
+
+	switch r.Type {
+	case gauge:
+		c.ty = otlp.MetricDescriptor_INT64
+		if double {
+			c.ty = otlp.MetricDescriptor_DOUBLE
+		}
+	case counter:
+		c.ty = otlp.MetricDescriptor_MONOTONIC_INT64
+		if double {
+			c.ty = otlp.MetricDescriptor_MONOTONIC_DOUBLE
+		}
+	case histogram, summary:
+		if r.ValueType != "" {
+			return c, fmt.Errorf("%s %s cannot have a value type", r.Type, r.Name)
+		}
+		c.ty = otlp.MetricDescriptor_HISTOGRAM
+		if r.Type == summary {
+			c.ty = otlp.MetricDescriptor_SUMMARY
+		}
+	default:
+		return c, fmt.Errorf("invalid metric type %q", r.Type)
+	}
+	if r.OTLPType != "" {
+		ty, ok := otlp.MetricDescriptor_Type_value[strings.ToUpper(r.OTLPType)]
+		if !ok {
+			return c, fmt.Errorf("unknown OTLP type %q", r.OTLPType)
+		}
+		c.ty = otlp.MetricDescriptor_Type(ty)
+	}
+
+	c.temp = otlp.MetricDescriptor_CUMULATIVE
+	if r.Temporality != "" {
+		temp, ok := otlp.MetricDescriptor_Temporality_value[strings.ToUpper(r.Temporality)]
+		if !ok {
+			return c, fmt.Errorf("unknown temporality %q", r.Temporality)
+		}
+		c.temp = otlp.MetricDescriptor_Temporality(temp)
+	}
+	return c, nil
+}
+
+// setCombination sets the type, value type and temporality of r to those of the OTLP combination c. A metric of a type
+// that has no record type, like INVALID_TYPE, is a gauge with an int64 value and the OTLP type of c.
+func setCombination(r *record, c combination) {
+	r.ValueType, r.OTLPType = "", ""
+	switch c.ty {
+	case otlp.MetricDescriptor_INT64:
+		r.Type, r.ValueType = gauge, int64Value
+	case otlp.MetricDescriptor_DOUBLE:
+		r.Type, r.ValueType = gauge, doubleValue
+	case otlp.MetricDescriptor_MONOTONIC_INT64:
+		r.Type, r.ValueType = counter, int64Value
+	case otlp.MetricDescriptor_MONOTONIC_DOUBLE:
+		r.Type, r.ValueType = counter, doubleValue
+	case otlp.MetricDescriptor_HISTOGRAM:
+		r.Type = histogram
+	case otlp.MetricDescriptor_SUMMARY:
+		r.Type = summary
+	default:
+		r.Type, r.ValueType, r.OTLPType = gauge, int64Value, strings.ToLower(c.ty.String())
+	}
+	r.Temporality = strings.ToLower(c.temp.String())
+}
+
+// validCombination reports whether c is one of the validCombinations, which the exporter writes to Cortex. Gauges are
+// written whatever their temporality, which the exporter does not check. Metrics of any other combination are dropped.
+func validCombination(c combination) bool {
+	if c.ty == otlp.MetricDescriptor_INT64 || c.ty == otlp.MetricDescriptor_DOUBLE {
+		return true
+	}
+	for _, valid := range validCombinations {
+		if c == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// exportedName returns the name of the time series the exporter writes for r, or the base name of its series for
+// histograms and summaries. The name is prefixed with the namespace of the exporter, if set, and sanitized like label
+// names, and like Prometheus counters, the names of monotonic metrics end with _total.
+func exportedName(r *record) string {
+	return prefixedName(namespace, r)
+}
+
+// prefixedName returns the exported name of r with the namespace ns
+func prefixedName(ns string, r *record) string {
+	name := r.Name
+	if ns != "" {
+		name = ns + "_" + name
+	}
+	name = sanitize(name)
+	if r.Type == counter {
+		return name + "_total"
+	}
+	return name
+}
+
+func buildScalarMetric(name string, labels []*common.StringKeyValue, val float64, kind int, ts uint64) *metrics.Metric {
 	return &metrics.Metric{
 		MetricDescriptor: getDescriptor(name, kind, validCombinations),
 		Int64DataPoints: []*metrics.Int64DataPoint{
-			getIntDataPoint(labels, int64(val), uint64(time.Now().UnixNano())),
+			getIntDataPoint(labels, int64(val), ts),
 		},
 	}
 }
 
-func buildHistogramMetric(name string, labels []*common.StringKeyValue, val []uint64) *metrics.Metric {
-
-	sum := float64(val[0])
-	count := val[1]
-	buckets := val[2:]
+func buildDoubleMetric(name string, labels []*common.StringKeyValue, val float64, kind int, ts uint64) *metrics.Metric {
+	return &metrics.Metric{
+		MetricDescriptor: getDescriptor(name, kind, validCombinations),
+		DoubleDataPoints: []*metrics.DoubleDataPoint{
+			getDoubleDataPoint(labels, val, ts),
+		},
+	}
+}
 
+func buildHistogramMetric(name string, labels []*common.StringKeyValue, ts uint64, sum float64, count uint64, bounds []float64, buckets []uint64) *metrics.Metric {
 	return &metrics.Metric{
 		MetricDescriptor: getDescriptor(name, histogramComb, validCombinations),
 		HistogramDataPoints: []*metrics.HistogramDataPoint{
-			getHistogramDataPoint(labels, uint64(time.Now().UnixNano()), sum, count, bounds, buckets),
+			getHistogramDataPoint(labels, ts, sum, count, bounds, buckets),
 		},
 	}
 }
-func buildSummaryMetric(name string, labels []*common.StringKeyValue, val []float64) *metrics.Metric {
-	sum := val[0]
-	count := uint64(val[1])
-	pcts := make([]float64, len(bounds), len(bounds))
-	values := make([]float64, len(bounds), len(bounds))
-	for i, bound := range bounds {
-		pcts[i] = bound
-		values[i] = val[2+i]
-	}
+
+func buildSummaryMetric(name string, labels []*common.StringKeyValue, ts uint64, sum float64, count uint64, pcts []float64, values []float64) *metrics.Metric {
 	return &metrics.Metric{
 		MetricDescriptor: getDescriptor(name, summaryComb, validCombinations),
 		SummaryDataPoints: []*metrics.SummaryDataPoint{
-			getSummaryDataPoint(labels, uint64(time.Now().UnixNano()), sum, count, pcts, values),
+			getSummaryDataPoint(labels, ts, sum, count, pcts, values),
 		},
 	}
 }
 
-func parseNumber(str string) float64 {
+// labelPairs flattens labels into name value pairs sorted by name
+func labelPairs(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k, labels[k])
+	}
+	return pairs
+}
+
+// getAttributes converts attrs to string attributes sorted by key
+func getAttributes(attrs map[string]string) []*common.KeyValue {
+	pairs := labelPairs(attrs)
+	var result []*common.KeyValue
+	for i := 0; i < len(pairs); i += 2 {
+		result = append(result, &common.KeyValue{
+			Key:   pairs[i],
+			Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: pairs[i+1]}},
+		})
+	}
+	return result
+}
+
+// requestGroup identifies the resource and instrumentation library of a metric
+type requestGroup struct {
+	resource string
+	library  string
+	version  string
+}
+
+// buildRequest builds a request of ms, where ms[i] was built from records[i]. Metrics are grouped into a
+// ResourceMetrics for each resource and an InstrumentationLibraryMetrics for each library, in the order the groups
+// first appear in records.
+func buildRequest(records []*record, ms []*metrics.Metric) *service.ExportMetricsServiceRequest {
+	request := &service.ExportMetricsServiceRequest{}
+	resources := make(map[string]*metrics.ResourceMetrics)
+	libraries := make(map[requestGroup]*metrics.InstrumentationLibraryMetrics)
+	for i, r := range records {
+		group := requestGroup{labelMapSignature(r.Resource), r.Library, r.LibraryVersion}
+		rm, ok := resources[group.resource]
+		if !ok {
+			rm = &metrics.ResourceMetrics{}
+			if len(r.Resource) > 0 {
+				rm.Resource = &resource.Resource{Attributes: getAttributes(r.Resource)}
+			}
+			resources[group.resource] = rm
+			request.ResourceMetrics = append(request.ResourceMetrics, rm)
+		}
+		ilm, ok := libraries[group]
+		if !ok {
+			ilm = &metrics.InstrumentationLibraryMetrics{}
+			if r.Library != "" || r.LibraryVersion != "" {
+				ilm.InstrumentationLibrary = &common.InstrumentationLibrary{Name: r.Library, Version: r.LibraryVersion}
+			}
+			libraries[group] = ilm
+			rm.InstrumentationLibraryMetrics = append(rm.InstrumentationLibraryMetrics, ilm)
+		}
+		ilm.Metrics = append(ilm.Metrics, ms[i])
+	}
+	return request
+}
+
+// sanitize converts name to a valid Prometheus label name the way the exporter does: every character other than a
+// letter, digit or underscore is replaced with an underscore, and a name starting with a digit or an underscore gets a
+// "key" prefix
+func sanitize(name string) string {
+	if name == "" {
+		return name
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	if unicode.IsDigit(rune(name[0])) {
+		name = "key_" + name
+	} else if name[0] == '_' {
+		name = "key" + name
+	}
+	return name
+}
+
+// parseNumber parses a single number, optionally in square brackets
+func parseNumber(str string) (float64, error) {
 	str = strings.Replace(str, "[", space, -1)
 	str = strings.Replace(str, "]", space, -1)
 	str = strings.Trim(str, space)
-	num, _ := strconv.ParseFloat(str, 64)
-	return num
+	return strconv.ParseFloat(str, 64)
 }
-func parseuUInt64Slice(str string) []uint64 {
-	arr := strings.Split(strings.Trim(str, space), space)
-	result := make([]uint64, len(arr), len(arr))
-	for i, numStr := range arr {
-		num, _ := strconv.Atoi(numStr)
-		result[i] = uint64(num)
+
+// parseuUInt64Slice parses space-separated unsigned integers
+func parseuUInt64Slice(str string) ([]uint64, error) {
+	fields := strings.Fields(str)
+	result := make([]uint64, len(fields))
+	for i, numStr := range fields {
+		num, err := strconv.ParseUint(numStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = num
 	}
-	return result
+	return result, nil
 }
-func parseFloat64Slice(str string) []float64 {
-	arr := strings.Split(strings.Trim(str, space), space)
-	result := make([]float64, len(arr), len(arr))
-	for i, numStr := range arr {
-		result[i] = parseNumber(numStr)
+
+// parseFloat64Slice parses space-separated numbers, each optionally in square brackets
+func parseFloat64Slice(str string) ([]float64, error) {
+	fields := strings.Fields(str)
+	result := make([]float64, len(fields))
+	for i, numStr := range fields {
+		num, err := parseNumber(numStr)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = num
 	}
-	return result
+	return result, nil
+}
+
+// parseBucketLayout returns the histogram bounds of a bucket layout, which is one of
+//
+//	linear START WIDTH COUNT       COUNT bounds WIDTH apart, starting at START
+//	exponential START FACTOR COUNT COUNT bounds, each FACTOR times the previous one, starting at START
+//	custom BOUND...                the given bounds, in increasing order
+//	none                           no bounds, so that every value is in the overflow bucket
+func parseBucketLayout(layout string) ([]float64, error) {
+	fields := strings.Fields(layout)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty bucket layout")
+	}
+	params, err := parseFloat64Slice(strings.Join(fields[1:], space))
+	if err != nil {
+		return nil, fmt.Errorf("bucket layout %q: %v", layout, err)
+	}
+
+	var result []float64
+	switch fields[0] {
+	case "linear", "exponential":
+		if len(params) != 3 || params[2] != math.Trunc(params[2]) || params[2] < 1 {
+			return nil, fmt.Errorf("bucket layout %q must have a start, a step and a positive count", layout)
+		}
+		start, step, count := params[0], params[1], int(params[2])
+		for i := 0; i < count; i++ {
+			if fields[0] == "linear" {
+				result = append(result, start+float64(i)*step)
+			} else {
+				result = append(result, start*math.Pow(step, float64(i)))
+			}
+		}
+	case "custom":
+		result = params
+	case "none":
+		if len(params) > 0 {
+			return nil, fmt.Errorf("bucket layout %q has no parameters", layout)
+		}
+	default:
+		return nil, fmt.Errorf("unknown bucket layout %q", layout)
+	}
+	for i := 1; i < len(result); i++ {
+		if !(result[i] > result[i-1]) {
+			return nil, fmt.Errorf("bucket layout %q: bounds must be in increasing order", layout)
+		}
+	}
+	return result, nil
+}
+
+// sampleQuantile returns the q-quantile of the non-empty sorted sample by the nearest-rank method: the smallest value
+// that at least q of the sample is less than or equal to. The 0-quantile is the minimum and the 1-quantile the maximum.
+func sampleQuantile(sorted []float64, q float64) float64 {
+	rank := int(math.Ceil(q * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
 }
@@ -0,0 +1,87 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func FuzzParseNumber(f *testing.F) {
+	for _, seed := range []string{"42", "0.686823", "[3.5]", "", "abc", "-1e3"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, str string) {
+		got, err := parseNumber(str)
+		// a number formatted by the generator must parse back to itself
+		if want, wantErr := strconv.ParseFloat(str, 64); wantErr == nil && !math.IsNaN(want) && (err != nil || got != want) {
+			t.Errorf("parseNumber(%q) = %v, %v, want %v", str, got, err, want)
+		}
+	})
+}
+
+func FuzzParseUint64Slice(f *testing.F) {
+	for _, seed := range []string{"3287 9252 1258 ", "", "1 x 3", " ", "18446744073709551615"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, str string) {
+		got, err := parseuUInt64Slice(str)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(str)
+		if len(got) != len(fields) {
+			t.Fatalf("parseuUInt64Slice(%q) returned %d values, want %d", str, len(got), len(fields))
+		}
+		// the values must round-trip through their formatted form
+		formatted := make([]string, len(got))
+		for i, v := range got {
+			if want, _ := strconv.ParseUint(fields[i], 10, 64); v != want {
+				t.Errorf("parseuUInt64Slice(%q)[%d] = %v, want %v", str, i, v, want)
+			}
+			formatted[i] = strconv.FormatUint(v, 10)
+		}
+		again, err := parseuUInt64Slice(strings.Join(formatted, space))
+		if err != nil || len(again) != len(got) {
+			t.Fatalf("parseuUInt64Slice(%q) = %v, %v, want %v", strings.Join(formatted, space), again, err, got)
+		}
+		for i := range got {
+			if again[i] != got[i] {
+				t.Errorf("value %d: %v did not round-trip, got %v", i, got[i], again[i])
+			}
+		}
+	})
+}
+
+func FuzzParseFloat64Slice(f *testing.F) {
+	for _, seed := range []string{"4059 2081 0.686823 ", "", "[1] [2.5]", "1 x", "1e308 -0 NaN +Inf"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, str string) {
+		got, err := parseFloat64Slice(str)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(str)
+		if len(got) != len(fields) {
+			t.Fatalf("parseFloat64Slice(%q) returned %d values, want %d", str, len(got), len(fields))
+		}
+		// the values must round-trip through their formatted form, bit for bit so that NaN and -0 count
+		formatted := make([]string, len(got))
+		for i, v := range got {
+			formatted[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		again, err := parseFloat64Slice(strings.Join(formatted, space))
+		if err != nil || len(again) != len(got) {
+			t.Fatalf("parseFloat64Slice(%q) = %v, %v, want %v", strings.Join(formatted, space), again, err, got)
+		}
+		for i := range got {
+			if math.Float64bits(again[i]) != math.Float64bits(got[i]) {
+				t.Errorf("value %d: %v did not round-trip, got %v", i, got[i], again[i])
+			}
+		}
+	})
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	common "github.com/open-telemetry/opentelemetry-proto/gen/go/common/v1"
+	otlp "github.com/open-telemetry/opentelemetry-proto/gen/go/metrics/v1"
+)
+
+func Test_getLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []string
+		want   []*common.StringKeyValue
+	}{
+		{
+			"no_labels",
+			[]string{},
+			nil,
+		},
+		{
+			"one_pair",
+			[]string{label11, value11},
+			[]*common.StringKeyValue{{Key: label11, Value: value11}},
+		},
+		{
+			"two_pairs",
+			[]string{label11, value11, label12, value12},
+			[]*common.StringKeyValue{{Key: label11, Value: value11}, {Key: label12, Value: value12}},
+		},
+		{
+			"odd_length",
+			[]string{label11, value11, label12},
+			[]*common.StringKeyValue{{Key: label11, Value: value11}},
+		},
+		{
+			"single_key",
+			[]string{label11},
+			nil,
+		},
+		{
+			"empty_strings",
+			[]string{"", ""},
+			[]*common.StringKeyValue{{Key: "", Value: ""}},
+		},
+		{
+			"dirty_keys",
+			[]string{label11 + dirty1, value11, dirty2 + label12, value12},
+			lbs1Dirty,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getLabels(tt.labels...)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !proto.Equal(got[i], tt.want[i]) {
+					t.Errorf("label %d: got %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_getDescriptor(t *testing.T) {
+	tests := []struct {
+		name string
+		comb []combination
+	}{
+		{"valid", validCombinations},
+		{"invalid", invalidCombinations},
+	}
+	for _, tt := range tests {
+		for i, comb := range tt.comb {
+			t.Run(tt.name+"_"+strconv.Itoa(i), func(t *testing.T) {
+				desc := getDescriptor(name1, i, tt.comb)
+				if desc.Name != name1 {
+					t.Errorf("name: got %s, want %s", desc.Name, name1)
+				}
+				if desc.Type != comb.ty || desc.Temporality != comb.temp {
+					t.Errorf("got %v/%v, want %v/%v", desc.Type, desc.Temporality, comb.ty, comb.temp)
+				}
+			})
+		}
+	}
+}
+
+func Test_combinations(t *testing.T) {
+	tests := []struct {
+		name  string
+		index int
+		ty    otlp.MetricDescriptor_Type
+	}{
+		{"monotonic_int64", monotonicInt64Comb, otlp.MetricDescriptor_MONOTONIC_INT64},
+		{"monotonic_double", monotonicDoubleComb, otlp.MetricDescriptor_MONOTONIC_DOUBLE},
+		{"histogram", histogramComb, otlp.MetricDescriptor_HISTOGRAM},
+		{"summary", summaryComb, otlp.MetricDescriptor_SUMMARY},
+		{"int64", intComb, otlp.MetricDescriptor_INT64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validCombinations[tt.index].ty; got != tt.ty {
+				t.Errorf("got %v, want %v", got, tt.ty)
+			}
+		})
+	}
+	// every invalid combination is either non-cumulative or has an invalid type or temporality, and is only listed once.
+	// None is a gauge, which the exporter writes whatever its temporality.
+	seen := make(map[combination]bool)
+	for i, comb := range invalidCombinations {
+		if comb.temp == otlp.MetricDescriptor_CUMULATIVE && comb.ty != otlp.MetricDescriptor_INVALID_TYPE {
+			t.Errorf("invalid combination %d is valid: %v/%v", i, comb.ty, comb.temp)
+		}
+		if comb.ty == otlp.MetricDescriptor_INT64 || comb.ty == otlp.MetricDescriptor_DOUBLE {
+			t.Errorf("invalid combination %d is a gauge: %v/%v", i, comb.ty, comb.temp)
+		}
+		if seen[comb] {
+			t.Errorf("invalid combination %d is a repeat: %v/%v", i, comb.ty, comb.temp)
+		}
+		seen[comb] = true
+	}
+}
+
+func Test_getIntDataPoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []*common.StringKeyValue
+		value  int64
+		ts     uint64
+	}{
+		{"with_labels", lbs1, intVal1, 1},
+		{"no_labels", nil, intVal2, 2},
+		{"negative", lbs2, -intVal1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := &otlp.Int64DataPoint{Labels: tt.labels, TimeUnixNano: tt.ts, Value: tt.value}
+			if got := getIntDataPoint(tt.labels, tt.value, tt.ts); !proto.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_getHistogramDataPoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		sum     float64
+		count   uint64
+		bounds  []float64
+		buckets []uint64
+	}{
+		{"three_buckets", floatVal1, 6, []float64{0.01, 0.5, 0.99}, []uint64{1, 2, 3}},
+		{"overflow_bucket", floatVal2, 10, []float64{0.01, 0.5, 0.99}, []uint64{1, 2, 3, 4}},
+		{"no_buckets", 0, 0, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getHistogramDataPoint(lbs1, 1, tt.sum, tt.count, tt.bounds, tt.buckets)
+			if got.Sum != tt.sum || got.Count != tt.count || got.TimeUnixNano != 1 {
+				t.Errorf("got sum %v count %v ts %v", got.Sum, got.Count, got.TimeUnixNano)
+			}
+			if !reflect.DeepEqual(got.ExplicitBounds, tt.bounds) {
+				t.Errorf("bounds: got %v, want %v", got.ExplicitBounds, tt.bounds)
+			}
+			if len(got.Buckets) != len(tt.buckets) {
+				t.Fatalf("buckets: got %v, want %v", got.Buckets, tt.buckets)
+			}
+			for i, bk := range got.Buckets {
+				if bk.Count != tt.buckets[i] {
+					t.Errorf("bucket %d: got %v, want %v", i, bk.Count, tt.buckets[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_getSummaryDataPoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		pcts   []float64
+		values []float64
+	}{
+		{"three_quantiles", []float64{0.01, 0.5, 0.99}, []float64{0.1, 0.2, 0.3}},
+		{"no_quantiles", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getSummaryDataPoint(lbs2, 1, floatVal1, uint64(intVal2), tt.pcts, tt.values)
+			if got.Sum != floatVal1 || got.Count != uint64(intVal2) {
+				t.Errorf("got sum %v count %v", got.Sum, got.Count)
+			}
+			if len(got.PercentileValues) != len(tt.values) {
+				t.Fatalf("got %v, want %v", got.PercentileValues, tt.values)
+			}
+			for i, p := range got.PercentileValues {
+				if p.Percentile != tt.pcts[i] || p.Value != tt.values[i] {
+					t.Errorf("quantile %d: got %v", i, p)
+				}
+			}
+		})
+	}
+}
+
+func Test_buildScalarMetric(t *testing.T) {
+	m := buildScalarMetric(name1, lbs1, 42.9, intComb, 1)
+	if m.MetricDescriptor.Name != name1 || m.MetricDescriptor.Type != otlp.MetricDescriptor_INT64 {
+		t.Errorf("got descriptor %v", m.MetricDescriptor)
+	}
+	if len(m.Int64DataPoints) != 1 || m.Int64DataPoints[0].Value != 42 || m.Int64DataPoints[0].TimeUnixNano != 1 {
+		t.Errorf("got data points %v", m.Int64DataPoints)
+	}
+}
+
+func Test_buildDoubleMetric(t *testing.T) {
+	m := buildDoubleMetric(name1, lbs1, 42.9, doubleComb, 1)
+	if m.MetricDescriptor.Name != name1 || m.MetricDescriptor.Type != otlp.MetricDescriptor_DOUBLE {
+		t.Errorf("got descriptor %v", m.MetricDescriptor)
+	}
+	if len(m.DoubleDataPoints) != 1 || m.DoubleDataPoints[0].Value != 42.9 || m.DoubleDataPoints[0].TimeUnixNano != 1 {
+		t.Errorf("got data points %v", m.DoubleDataPoints)
+	}
+}
+
+func Test_buildHistogramMetric(t *testing.T) {
+	m := buildHistogramMetric(name1, lbs1, 1, 10, 6, bounds, []uint64{1, 2, 3})
+	if m.MetricDescriptor.Type != otlp.MetricDescriptor_HISTOGRAM {
+		t.Errorf("got descriptor %v", m.MetricDescriptor)
+	}
+	pt := m.HistogramDataPoints[0]
+	if pt.Sum != 10 || pt.Count != 6 || len(pt.Buckets) != 3 || !reflect.DeepEqual(pt.ExplicitBounds, bounds) {
+		t.Errorf("got data point %v", pt)
+	}
+}
+
+func Test_buildSummaryMetric(t *testing.T) {
+	m := buildSummaryMetric(name1, lbs2, 1, 10, 6, quantiles, []float64{0.1, 0.2, 0.3})
+	if m.MetricDescriptor.Type != otlp.MetricDescriptor_SUMMARY {
+		t.Errorf("got descriptor %v", m.MetricDescriptor)
+	}
+	pt := m.SummaryDataPoints[0]
+	if pt.Sum != 10 || pt.Count != 6 || len(pt.PercentileValues) != len(quantiles) {
+		t.Fatalf("got data point %v", pt)
+	}
+	for i, p := range pt.PercentileValues {
+		if p.Percentile != quantiles[i] {
+			t.Errorf("quantile %d: got %v, want %v", i, p.Percentile, quantiles[i])
+		}
+	}
+}
+
+func Test_buildMetric(t *testing.T) {
+	value, fraction := 7.0, 7.25
+	tests := []struct {
+		name    string
+		r       *record
+		wantErr bool
+	}{
+		{"gauge", &record{Name: name1, Type: gauge, Labels: map[string]string{label11: value11}, Value: &value}, false},
+		{"counter", &record{Name: name1, Type: counter, Value: &value, Timestamp: 1}, false},
+		{"double_gauge", &record{Name: name1, Type: gauge, ValueType: doubleValue, Temporality: "delta", Value: &fraction}, false},
+		{"double_counter", &record{Name: name1, Type: counter, ValueType: doubleValue, Value: &fraction}, false},
+		{"histogram", &record{Name: name1, Type: histogram, Sum: 1, Count: 3, Bounds: bounds, Buckets: []uint64{1, 1, 0, 1}}, false},
+		{"no_overflow_bucket", &record{Name: name1, Type: histogram, Sum: 1, Count: 3, Bounds: bounds, Buckets: []uint64{1, 1, 1}}, false},
+		{"no_bounds", &record{Name: name1, Type: histogram, Sum: 1, Count: 3, Buckets: []uint64{3}}, false},
+		{"summary", &record{Name: name1, Type: summary, Sum: 1, Count: 3, Quantiles: []quantile{{0.5, 1}}}, false},
+		{"invalid_type", &record{Name: name1, Type: gauge, OTLPType: "invalid_type", Value: &value}, false},
+		{"invalid_temporality", &record{Name: name1, Type: counter, Temporality: "invalid_temporality", Value: &value}, false},
+		{"gauge_invalid_temporality", &record{Name: name1, Type: gauge, Temporality: "invalid_temporality", Value: &value}, false},
+		{"invalid_type_and_temporality", &record{Name: name1, Type: gauge, OTLPType: "invalid_type", Temporality: "invalid_temporality", Value: &value}, false},
+		{"delta_counter", &record{Name: name1, Type: counter, Temporality: "delta", Value: &value}, false},
+		{"missing_value", &record{Name: name1, Type: gauge}, true},
+		{"unknown_type", &record{Name: name1, Type: "set"}, true},
+		{"fractional_int64", &record{Name: name1, Type: gauge, ValueType: int64Value, Value: &fraction}, true},
+		{"invalid_value_type", &record{Name: name1, Type: gauge, ValueType: "int32", Value: &value}, true},
+		{"histogram_value_type", &record{Name: name1, Type: histogram, ValueType: doubleValue}, true},
+		{"unknown_temporality", &record{Name: name1, Type: gauge, Temporality: "weekly", Value: &value}, true},
+		{"unknown_otlp_type", &record{Name: name1, Type: gauge, OTLPType: "int32", Value: &value}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := buildMetric(tt.r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, err := recordFromMetric(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.r.Name || labelMapSignature(got.Labels) != labelMapSignature(tt.r.Labels) {
+				t.Errorf("got %v %v, want %v %v", got.Name, got.Labels, tt.r.Name, tt.r.Labels)
+			}
+			if tt.r.Timestamp != 0 && got.Timestamp != tt.r.Timestamp {
+				t.Errorf("timestamp: got %d, want %d", got.Timestamp, tt.r.Timestamp)
+			}
+			comb, _ := metricCombination(tt.r)
+			if m.MetricDescriptor.Type != comb.ty || m.MetricDescriptor.Temporality != comb.temp {
+				t.Errorf("got %v %v, want %v %v", m.MetricDescriptor.Type, m.MetricDescriptor.Temporality, comb.ty, comb.temp)
+			}
+			if mismatches := compareRecords(tt.r, got); len(mismatches) > 0 {
+				t.Errorf("mismatches: %v", mismatches)
+			}
+		})
+	}
+	// a metric without a descriptor keeps its data point
+	m, err := buildMetric(&record{Name: name1, Type: gauge, NoDescriptor: true, Value: &value})
+	if err != nil || m.MetricDescriptor != nil || len(m.Int64DataPoints) != 1 {
+		t.Errorf("no descriptor: got %v, %v", m, err)
+	}
+}
+
+func Test_metricCombination(t *testing.T) {
+	// every combination is the combination of a record, and only the valid ones are valid
+	for _, comb := range append(append([]combination{}, validCombinations...), invalidCombinations...) {
+		r := &record{}
+		setCombination(r, comb)
+		got, err := metricCombination(r)
+		if err != nil || got != comb {
+			t.Errorf("%v %v: got %v %v, %v", comb.ty, comb.temp, got.ty, got.temp, err)
+		}
+	}
+	for i, comb := range validCombinations {
+		if !validCombination(comb) {
+			t.Errorf("valid combination %d is invalid", i)
+		}
+	}
+	for i, comb := range invalidCombinations {
+		if validCombination(comb) {
+			t.Errorf("invalid combination %d is valid", i)
+		}
+	}
+	for _, temp := range []otlp.MetricDescriptor_Temporality{otlp.MetricDescriptor_DELTA,
+		otlp.MetricDescriptor_INVALID_TEMPORALITY} {
+		if comb := (combination{otlp.MetricDescriptor_DOUBLE, temp}); !validCombination(comb) {
+			t.Errorf("gauge of %v temporality is invalid", temp)
+		}
+	}
+	if r := (&record{Name: name1, Type: gauge, NoDescriptor: true}); r.valid() {
+		t.Errorf("a metric without a descriptor is valid")
+	}
+	got, err := metricCombination(&record{Type: counter})
+	if err != nil || got != validCombinations[monotonicInt64Comb] {
+		t.Errorf("default counter: got %v %v, %v", got.ty, got.temp, err)
+	}
+}
+
+func Test_exportedName(t *testing.T) {
+	tests := []struct {
+		name  string
+		mType string
+		want  string
+	}{
+		{name1, gauge, name1},
+		{name1, counter, name1 + "_total"},
+		{name1, histogram, name1},
+		{name1, summary, name1},
+		{dirty2 + name1, gauge, "key_" + name1},
+		{"1" + name1 + dirty1, counter, "key_1" + name1 + "__total"},
+		{"test.ns-" + name1, histogram, "test_ns_" + name1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"_"+tt.mType, func(t *testing.T) {
+			if got := exportedName(&record{Name: tt.name, Type: tt.mType}); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_prefixedName(t *testing.T) {
+	tests := []struct {
+		ns    string
+		name  string
+		mType string
+		want  string
+	}{
+		{"", name1, counter, name1 + "_total"},
+		{ns1, name1, gauge, ns1 + "_" + name1},
+		{ns1, name1, counter, ns1 + "_" + name1 + "_total"},
+		{ns1, dirty2 + name1, summary, ns1 + "__" + name1},
+		{"demo.app", "1" + name1, histogram, "demo_app_1" + name1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ns+"_"+tt.name, func(t *testing.T) {
+			if got := prefixedName(tt.ns, &record{Name: tt.name, Type: tt.mType}); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_labelPairs(t *testing.T) {
+	got := labelPairs(map[string]string{label12: value12, label11: value11})
+	want := []string{label11, value11, label12, value12}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func Test_getAttributes(t *testing.T) {
+	got := getAttributes(map[string]string{label12: value12, label11: value11})
+	if len(got) != 2 || got[0].Key != label11 || got[0].GetValue().GetStringValue() != value11 ||
+		got[1].Key != label12 || got[1].GetValue().GetStringValue() != value12 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func Test_buildRequest(t *testing.T) {
+	res1 := map[string]string{"service.name": "a"}
+	res2 := map[string]string{"service.name": "b"}
+	records := []*record{
+		{Name: "m0", Resource: res1, Library: "lib1", LibraryVersion: "1.0"},
+		{Name: "m1", Resource: res2, Library: "lib1", LibraryVersion: "1.0"},
+		{Name: "m2", Resource: res1, Library: "lib2"},
+		{Name: "m3", Resource: res1, Library: "lib1", LibraryVersion: "1.0"},
+		{Name: "m4"},
+	}
+	ms := make([]*otlp.Metric, len(records))
+	for i, r := range records {
+		ms[i] = &otlp.Metric{MetricDescriptor: &otlp.MetricDescriptor{Name: r.Name}}
+	}
+
+	// resource -> library -> metric names
+	want := [][][]string{
+		{{"m0", "m3"}, {"m2"}},
+		{{"m1"}},
+		{{"m4"}},
+	}
+	req := buildRequest(records, ms)
+	var got [][][]string
+	for _, rm := range req.ResourceMetrics {
+		var libs [][]string
+		for _, ilm := range rm.InstrumentationLibraryMetrics {
+			var names []string
+			for _, m := range ilm.Metrics {
+				names = append(names, m.MetricDescriptor.Name)
+			}
+			libs = append(libs, names)
+		}
+		got = append(got, libs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	first := req.ResourceMetrics[0]
+	if attrs := first.GetResource().GetAttributes(); len(attrs) != 1 || attrs[0].GetValue().GetStringValue() != "a" {
+		t.Errorf("resource: got %v", attrs)
+	}
+	lib := first.InstrumentationLibraryMetrics[0].InstrumentationLibrary
+	if lib.GetName() != "lib1" || lib.GetVersion() != "1.0" {
+		t.Errorf("library: got %v", lib)
+	}
+	last := req.ResourceMetrics[2]
+	if lib := last.InstrumentationLibraryMetrics[0].InstrumentationLibrary; last.Resource != nil || lib != nil {
+		t.Errorf("got resource %v and library %v, want none", last.Resource, lib)
+	}
+}
+
+func Test_sanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", ""},
+		{"valid_name1", "valid_name1"},
+		{"service.name", "service_name"},
+		{"host-name/ip", "host_name_ip"},
+		{"0day", "key_0day"},
+		{"_private", "key_private"},
+		{".dot", "key_dot"},
+		{label11 + dirty1, label11 + "_"},
+		{dirty2 + label12, "key_" + label12},
+		{"7" + label11, "key_7" + label11},
+		{"temp°c→f", "temp_c_f"},
+		{"größe", "größe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitize(tt.name); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseNumber(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    float64
+		wantErr bool
+	}{
+		{"integer", "42", 42, false},
+		{"float", "0.686823", 0.686823, false},
+		{"negative", "-1.5", -1.5, false},
+		{"padded", "  7 ", 7, false},
+		{"bracketed", "[3.5]", 3.5, false},
+		{"open_bracket", "[3.5", 3.5, false},
+		{"exponent", "1e3", 1000, false},
+		{"empty", "", 0, true},
+		{"malformed", "abc", 0, true},
+		{"two_numbers", "1 2", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNumber(tt.str)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseuUInt64Slice(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    []uint64
+		wantErr bool
+	}{
+		{"histogram_values", "3287 9252 1258 3047 4947 ", []uint64{3287, 9252, 1258, 3047, 4947}, false},
+		{"single", "5", []uint64{5}, false},
+		{"double_space", "1  2", []uint64{1, 2}, false},
+		{"empty", "", []uint64{}, false},
+		{"malformed", "1 x 3", nil, true},
+		{"float", "1.5", nil, true},
+		{"negative", "-1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseuUInt64Slice(tt.str)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseFloat64Slice(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    []float64
+		wantErr bool
+	}{
+		{"summary_values", "4059 2081 0.686823 0.065637 0.156519 ", []float64{4059, 2081, 0.686823, 0.065637, 0.156519}, false},
+		{"bracketed", "[1] [2.5]", []float64{1, 2.5}, false},
+		{"empty", "", []float64{}, false},
+		{"malformed", "1 x", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFloat64Slice(tt.str)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseBucketLayout(t *testing.T) {
+	tests := []struct {
+		layout  string
+		want    []float64
+		wantErr bool
+	}{
+		{"linear 0 10 4", []float64{0, 10, 20, 30}, false},
+		{"exponential 0.5 2 4", []float64{0.5, 1, 2, 4}, false},
+		{"custom 0.01 0.5 0.99", bounds, false},
+		{"custom", nil, false},
+		{"none", nil, false},
+		{" linear  1 1  1 ", []float64{1}, false},
+		{"", nil, true},
+		{"log 1 2 3", nil, true},
+		{"linear 0 10", nil, true},
+		{"linear 0 10 2.5", nil, true},
+		{"linear 0 10 0", nil, true},
+		{"linear 0 0 2", nil, true},
+		{"exponential 1 0.5 3", nil, true},
+		{"custom 1 1", nil, true},
+		{"custom 1 x", nil, true},
+		{"none 1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.layout, func(t *testing.T) {
+			got, err := parseBucketLayout(tt.layout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) && (len(got) > 0 || len(tt.want) > 0) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// hundreds of buckets
+	got, err := parseBucketLayout("linear 0 0.1 500")
+	if err != nil || len(got) != 500 {
+		t.Errorf("got %d bounds, %v", len(got), err)
+	}
+}
+
+func Test_sampleQuantile(t *testing.T) {
+	sample := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := []struct {
+		name   string
+		sample []float64
+		q      float64
+		want   float64
+	}{
+		{"minimum", sample, 0, 1},
+		{"first_rank", sample, 0.01, 1},
+		{"median", sample, 0.5, 5},
+		{"between_ranks", sample, 0.55, 6},
+		{"p99", sample, 0.99, 10},
+		{"maximum", sample, 1, 10},
+		{"single_value", []float64{3}, 0.5, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sampleQuantile(tt.sample, tt.q); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseLegacyRecord(t *testing.T) {
+	value := 694.0
+	tests := []struct {
+		name    string
+		line    string
+		want    *record
+		wantErr bool
+	}{
+		{"counter", "metricName13081,counter,label1 value1 ,694", &record{
+			Name: "metricName13081", Type: counter, Labels: map[string]string{"label1": "value1"}, Value: &value,
+		}, false},
+		{"histogram", "metricName43081,histogram,label1 value1 ,3287 9252 1258 3047 4947 ", &record{
+			Name: "metricName43081", Type: histogram, Labels: map[string]string{"label1": "value1"},
+			Sum: 3287, Count: 9252, Buckets: []uint64{1258, 3047, 4947}, Bounds: bounds,
+		}, false},
+		{"summary", "metricName23081,summary,label1 value1 label2 value2 ,89 4728 0.468890 0.283034 0.293102 ", &record{
+			Name: "metricName23081", Type: summary, Labels: map[string]string{"label1": "value1", "label2": "value2"},
+			Sum: 89, Count: 4728, Quantiles: []quantile{
+				{quantiles[0], 0.468890}, {quantiles[1], 0.283034}, {quantiles[2], 0.293102},
+			},
+		}, false},
+		{"missing_field", "metricName13081,counter,694", nil, true},
+		{"odd_labels", "metricName13081,counter,label1 ,694", nil, true},
+		{"unknown_type", "metricName13081,meter,label1 value1 ,694", nil, true},
+		{"histogram_without_count", "metricName43081,histogram,label1 value1 ,3287", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLegacyRecord(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+var (
+	quantileTolerance = 1e-9 // relative tolerance for summary quantiles
+	valueTolerance    = 1e-9 // absolute tolerance for every other value
+)
+
+// verify compares the metrics in the input file with the query results in the output file. It returns a metricError
+// for each metric that is missing, unexpected or has mismatched values, and for each metric of an invalid type or
+// temporality that was not dropped.
+func verify(inputPath, outputPath string) error {
+	expected, err := readDataFile(inputPath)
+	if err != nil {
+		return err
+	}
+	actual, err := readDataFile(outputPath)
+	if err != nil {
+		return err
+	}
+
+	results := make(map[string]*record, len(actual))
+	byName := make(map[string][]*record)
+	for _, r := range actual {
+		results[r.key()] = r
+		byName[r.Name] = append(byName[r.Name], r)
+	}
+
+	var errs stageErrors
+	passed, dropped, leaked := 0, 0, 0
+	for _, exp := range expected {
+		exp.Name, exp.Labels = exportedName(exp), expectedLabels(exp)
+		exportBuckets(exp)
+		act, ok := results[exp.key()]
+		if !exp.valid() {
+			if !ok {
+				dropped++
+				passed++
+				continue
+			}
+			delete(results, exp.key())
+			leaked++
+			c, _ := metricCombination(exp)
+			err := fmt.Errorf("leaked through: expected the exporter to drop %v %v", c.ty, c.temp)
+			if exp.NoDescriptor {
+				err = errors.New("leaked through: expected the exporter to drop a metric without a descriptor")
+			}
+			errs = append(errs, &metricError{exp.Name, exp.Type, err})
+			continue
+		}
+		if !ok {
+			err := fmt.Errorf("missing from %s", outputPath)
+			// a series of the same name with other labels is most likely this one
+			for _, other := range byName[exp.Name] {
+				if _, ok := results[other.key()]; ok {
+					err = fmt.Errorf("labels: expected %v, got %v", exp.Labels, other.Labels)
+					delete(results, other.key())
+					break
+				}
+			}
+			errs = append(errs, &metricError{exp.Name, exp.Type, err})
+			continue
+		}
+		delete(results, exp.key())
+		compare := compareRecords
+		if queryRange {
+			compare = compareSamples
+		}
+		if mismatches := append(checkCumulativeBuckets(act), compare(exp, act)...); len(mismatches) > 0 {
+			errs = append(errs, &metricError{exp.Name, exp.Type, errors.New(strings.Join(mismatches, "; "))})
+			continue
+		}
+		passed++
+	}
+	// anything left over was returned by Cortex but never sent
+	for _, act := range actual {
+		if _, ok := results[act.key()]; ok {
+			err := fmt.Errorf("unexpected series on line %d of %s", act.line, outputPath)
+			errs = append(errs, &metricError{act.Name, act.Type, err})
+		}
+	}
+
+	log.Printf("verified %d metrics: %d passed, %d failed\n", len(expected), passed, len(expected)-passed)
+	if dropped+leaked > 0 {
+		log.Printf("invalid metrics: %d dropped, %d leaked\n", dropped, leaked)
+	}
+	return errs.err()
+}
+
+// expectedLabels returns the labels of the time series the exporter writes for r, with sanitized names: the const labels
+// of the exporter, overridden by the resource attributes of r if resourceLabels is set, and by the labels of r.
+func expectedLabels(r *record) map[string]string {
+	result := make(map[string]string, len(constLabels)+len(r.Labels)+len(r.Resource))
+	for k, v := range constLabels {
+		result[sanitize(k)] = v
+	}
+	if resourceLabels {
+		for k, v := range r.Resource {
+			result[sanitize(k)] = v
+		}
+	}
+	for k, v := range r.Labels {
+		result[sanitize(k)] = v
+	}
+	return result
+}
+
+// compareRecords returns a description of every difference between the expected and the actual record
+func compareRecords(exp, act *record) []string {
+	var mismatches []string
+	if exp.Type != act.Type {
+		return append(mismatches, fmt.Sprintf("type: expected %s, got %s", exp.Type, act.Type))
+	}
+	if len(exp.Points) > 0 || len(act.Points) > 0 {
+		expPoints, actPoints := exp.points(), act.points()
+		if len(expPoints) != len(actPoints) {
+			mismatches = append(mismatches, fmt.Sprintf("points: expected %d, got %d", len(expPoints), len(actPoints)))
+			if exp.timestamped() && act.timestamped() {
+				mismatches = append(mismatches, compareTimestamps(expPoints, actPoints)...)
+			}
+			return mismatches
+		}
+		for i := range expPoints {
+			for _, m := range compareRecords(exp.at(i), act.at(i)) {
+				mismatches = append(mismatches, fmt.Sprintf("point %d: %s", i, m))
+			}
+		}
+		return mismatches
+	}
+
+	// the exporter converts timestamps to milliseconds
+	expMs, actMs := exp.Timestamp/uint64(time.Millisecond), act.Timestamp/uint64(time.Millisecond)
+	if exp.Timestamp != 0 && act.Timestamp != 0 && expMs != actMs {
+		mismatches = append(mismatches, fmt.Sprintf("timestamp: expected %d ms, got %d ms", expMs, actMs))
+	}
+	return append(mismatches, compareValues(exp, act)...)
+}
+
+// compareTimestamps returns a mismatch for each expected point without a sample at the same millisecond, and for each
+// sample without a point
+func compareTimestamps(exp, act []point) []string {
+	expMs := make(map[uint64]bool, len(exp))
+	for _, p := range exp {
+		expMs[p.Timestamp/uint64(time.Millisecond)] = true
+	}
+	actMs := make(map[uint64]bool, len(act))
+	for _, p := range act {
+		actMs[p.Timestamp/uint64(time.Millisecond)] = true
+	}
+
+	var mismatches []string
+	for i, p := range exp {
+		if ms := p.Timestamp / uint64(time.Millisecond); !actMs[ms] {
+			mismatches = append(mismatches, fmt.Sprintf("point %d: no sample at %d ms", i, ms))
+		}
+	}
+	for _, p := range act {
+		if ms := p.Timestamp / uint64(time.Millisecond); !expMs[ms] {
+			mismatches = append(mismatches, fmt.Sprintf("unexpected sample at %d ms", ms))
+		}
+	}
+	return mismatches
+}
+
+// compareValues returns a description of every difference between the values of the expected and the actual single
+// point records
+func compareValues(exp, act *record) []string {
+	var mismatches []string
+	switch exp.Type {
+	case gauge, counter:
+		if act.Value == nil {
+			return append(mismatches, "value: missing")
+		}
+		mismatches = append(mismatches, compareValue("value", *exp.Value, *act.Value, valueTolerance)...)
+	case histogram:
+		mismatches = append(mismatches, compareValue("sum", exp.Sum, act.Sum, valueTolerance)...)
+		mismatches = append(mismatches, compareValue("count", float64(exp.Count), float64(act.Count), valueTolerance)...)
+		expBounds, expBuckets := bucketsByBound(exp)
+		actBounds, actBuckets := bucketsByBound(act)
+		if m := compareKeyed("bucket le=", expBounds, expBuckets, actBounds, actBuckets, compareValue, valueTolerance); len(m) > 0 {
+			mismatches = append(mismatches, m...)
+			mismatches = append(mismatches, diagnoseBuckets(exp, act)...)
+		}
+	case summary:
+		mismatches = append(mismatches, compareValue("sum", exp.Sum, act.Sum, valueTolerance)...)
+		mismatches = append(mismatches, compareValue("count", float64(exp.Count), float64(act.Count), valueTolerance)...)
+		expQuantiles, expValues := quantilesByQuantile(exp)
+		actQuantiles, actValues := quantilesByQuantile(act)
+		mismatches = append(mismatches,
+			compareKeyed("quantile ", expQuantiles, expValues, actQuantiles, actValues, compareRelative, quantileTolerance)...)
+	}
+	return mismatches
+}
+
+// bucketsByBound returns the bounds of the buckets of the single point histogram record r, with +Inf for the bucket
+// after the last bound, and the value of each bucket
+func bucketsByBound(r *record) ([]float64, []float64) {
+	var bounds, values []float64
+	for i, b := range r.Buckets {
+		bound := math.Inf(1)
+		if i < len(r.Bounds) {
+			bound = r.Bounds[i]
+		}
+		bounds = append(bounds, bound)
+		values = append(values, float64(b))
+	}
+	return bounds, values
+}
+
+// quantilesByQuantile returns the quantiles of the single point summary record r and the value of each
+func quantilesByQuantile(r *record) ([]float64, []float64) {
+	var quantiles, values []float64
+	for _, q := range r.Quantiles {
+		quantiles = append(quantiles, q.Quantile)
+		values = append(values, q.Value)
+	}
+	return quantiles, values
+}
+
+// compareKeyed compares the values of exp and act by their keys, the bucket bounds or quantiles, so that the order of
+// the time series Cortex returns does not matter, and returns a mismatch named prefix and the key for every value that
+// differs by more than tolerance according to compare, every key of exp missing from act and every key of act that is
+// not in exp
+func compareKeyed(prefix string, expKeys, expValues, actKeys, actValues []float64,
+	compare func(name string, exp, act, tolerance float64) []string, tolerance float64) []string {
+	name := func(key float64) string {
+		return prefix + formatSampleValue(key)
+	}
+	var mismatches []string
+	actByKey := make(map[float64]float64, len(actKeys))
+	for i, k := range actKeys {
+		if _, ok := actByKey[k]; ok {
+			mismatches = append(mismatches, name(k)+": duplicate")
+		}
+		actByKey[k] = actValues[i]
+	}
+	expByKey := make(map[float64]bool, len(expKeys))
+	for i, k := range expKeys {
+		expByKey[k] = true
+		v, ok := actByKey[k]
+		if !ok {
+			mismatches = append(mismatches, name(k)+": missing")
+			continue
+		}
+		mismatches = append(mismatches, compare(name(k), expValues[i], v, tolerance)...)
+	}
+	for _, k := range actKeys {
+		if !expByKey[k] {
+			mismatches = append(mismatches, name(k)+": unexpected")
+		}
+	}
+	return mismatches
+}
+
+// exportBuckets replaces the buckets of each point of the histogram r with the cumulative buckets the exporter writes:
+// the number of values up to each bound, which adds up the buckets of r, and the +Inf bucket, which is the count of r
+// and includes the overflow bucket
+func exportBuckets(r *record) {
+	if r.Type != histogram {
+		return
+	}
+	exportPoint := func(count uint64, buckets []uint64) []uint64 {
+		result := make([]uint64, 0, len(r.Bounds)+1)
+		var total uint64
+		for i := 0; i < len(r.Bounds) && i < len(buckets); i++ {
+			total += buckets[i]
+			result = append(result, total)
+		}
+		return append(result, count)
+	}
+	r.Buckets = exportPoint(r.Count, r.Buckets)
+	for i := range r.Points {
+		r.Points[i].Buckets = exportPoint(r.Points[i].Count, r.Points[i].Buckets)
+	}
+}
+
+// checkCumulativeBuckets returns a mismatch for each point of the histogram act whose buckets are not cumulative: a
+// bucket less than the one of the bound before it, or a +Inf bucket, the last one, that is not the count of the point.
+// Either is an exporter bug whatever the expected values are.
+func checkCumulativeBuckets(act *record) []string {
+	if act.Type != histogram {
+		return nil
+	}
+	var mismatches []string
+	for i, p := range act.points() {
+		var pointMismatches []string
+		bounds, buckets := bucketsByBound(act.at(i))
+		for j := 1; j < len(buckets); j++ {
+			if buckets[j] < buckets[j-1] {
+				pointMismatches = append(pointMismatches, fmt.Sprintf("bucket le=%s: %v is less than %v of le=%s, not cumulative",
+					formatSampleValue(bounds[j]), buckets[j], buckets[j-1], formatSampleValue(bounds[j-1])))
+				break
+			}
+		}
+		// a missing +Inf bucket is reported by compareValues
+		if n := len(p.Buckets); n == len(act.Bounds)+1 && p.Buckets[n-1] != p.Count {
+			pointMismatches = append(pointMismatches, fmt.Sprintf("+Inf bucket: %d is not the count %d", p.Buckets[n-1], p.Count))
+		}
+		for _, m := range pointMismatches {
+			if len(act.Points) > 0 {
+				m = fmt.Sprintf("point %d: %s", i, m)
+			}
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches
+}
+
+// diagnoseBuckets returns the exporter bug that most likely turned the buckets of the single point histogram record exp,
+// as converted by exportBuckets, into the different buckets of act, if any: writing the count of each bucket instead of
+// cumulative counts, leaving the overflow bucket out of the +Inf bucket, or counting it twice
+func diagnoseBuckets(exp, act *record) []string {
+	n := len(exp.Bounds)
+	if len(exp.Buckets) != n+1 || len(act.Buckets) != n+1 || len(act.Bounds) != n {
+		return nil
+	}
+	for i, b := range exp.Bounds {
+		if act.Bounds[i] != b {
+			return nil
+		}
+	}
+	// the buckets of the input file, the last one the overflow bucket
+	individual := make([]uint64, n+1)
+	for i, b := range exp.Buckets {
+		individual[i] = b
+		if i > 0 {
+			individual[i] -= exp.Buckets[i-1]
+		}
+	}
+	equal := func(a, b []uint64) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+	overflow, inf := individual[n], act.Buckets[n]
+	switch {
+	case n > 1 && equal(act.Buckets[:n], individual[:n]) && !equal(act.Buckets[:n], exp.Buckets[:n]):
+		return []string{"buckets: the count of each bucket, not the cumulative count"}
+	case !equal(act.Buckets[:n], exp.Buckets[:n]):
+		return nil
+	case overflow > 0 && inf == exp.Count-overflow:
+		return []string{"+Inf bucket: leaves out the overflow bucket"}
+	case overflow > 0 && inf == exp.Count+overflow:
+		return []string{"+Inf bucket: counts the overflow bucket twice"}
+	}
+	return nil
+}
+
+// compareSamples compares the samples of a range query with the points of exp. Consecutive samples of the same point
+// are merged, so the samples match if they are the points of exp in order, over and over if the input file was sent
+// more than once. A point that is skipped was dropped, and one that comes back after a later point was reordered.
+func compareSamples(exp, act *record) []string {
+	if exp.Type != act.Type {
+		return []string{fmt.Sprintf("type: expected %s, got %s", exp.Type, act.Type)}
+	}
+	for i := 1; i < len(act.Points); i++ {
+		if act.Points[i].Timestamp <= act.Points[i-1].Timestamp {
+			return []string{fmt.Sprintf("sample %d: timestamp %d is not after %d", i, act.Points[i].Timestamp,
+				act.Points[i-1].Timestamp)}
+		}
+	}
+
+	// a record without points has a single point of its own values, which is not a sample
+	if len(act.Points) == 0 {
+		return []string{"samples: missing"}
+	}
+	points := distinctPoints(exp)
+	samples := distinctPoints(act)
+	// when the input file is repeated, its last point is merged with the first one if they are the same
+	cycle := points
+	if len(cycle) > 1 && samePoint(exp, cycle[0], exp, cycle[len(cycle)-1]) {
+		cycle = cycle[:len(cycle)-1]
+	}
+	for i, s := range samples {
+		want := i % len(cycle)
+		if samePoint(exp, cycle[want], act, s) {
+			continue
+		}
+		for k, p := range cycle {
+			if !samePoint(exp, p, act, s) {
+				continue
+			}
+			if k > want {
+				// a skipped point that comes later in the same round was reordered rather than dropped
+				rest := samples[i+1:]
+				if len(rest) > len(cycle)-k {
+					rest = rest[:len(cycle)-k]
+				}
+				for _, later := range rest {
+					if samePoint(exp, cycle[want], act, later) {
+						return []string{fmt.Sprintf("sample %d: point %d reordered after point %d", later, cycle[want], p)}
+					}
+				}
+				return []string{fmt.Sprintf("sample %d: %s dropped", s, pointRange(cycle[want], p-1))}
+			}
+			return []string{fmt.Sprintf("sample %d: point %d reordered after point %d", s, p, cycle[want-1])}
+		}
+		var mismatches []string
+		for _, m := range compareValues(exp.at(cycle[want]), act.at(s)) {
+			mismatches = append(mismatches, fmt.Sprintf("sample %d: point %d: %s", s, cycle[want], m))
+		}
+		return mismatches
+	}
+	if len(samples) < len(points) {
+		return []string{fmt.Sprintf("%s dropped", pointRange(points[len(samples)], len(exp.points())-1))}
+	}
+	return nil
+}
+
+// distinctPoints returns the index of each point of r that differs from the previous one
+func distinctPoints(r *record) []int {
+	var result []int
+	for i := range r.points() {
+		if i == 0 || !samePoint(r, i-1, r, i) {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// pointRange formats the indexes of the points from first to last
+func pointRange(first, last int) string {
+	if first == last {
+		return fmt.Sprintf("point %d", first)
+	}
+	return fmt.Sprintf("points %d to %d", first, last)
+}
+
+// samePoint reports whether the ith point of a and the jth point of b have the same values
+func samePoint(a *record, i int, b *record, j int) bool {
+	return len(compareValues(a.at(i), b.at(j))) == 0
+}
+
+// compareValue returns a mismatch if exp and act differ by more than tolerance
+func compareValue(name string, exp, act, tolerance float64) []string {
+	if math.Abs(exp-act) > tolerance {
+		return []string{fmt.Sprintf("%s: expected %v, got %v", name, exp, act)}
+	}
+	return nil
+}
+
+// compareRelative returns a mismatch if exp and act differ by more than tolerance times the larger of their magnitudes
+func compareRelative(name string, exp, act, tolerance float64) []string {
+	if math.Abs(exp-act) > tolerance*math.Max(math.Abs(exp), math.Abs(act)) {
+		return []string{fmt.Sprintf("%s: expected %v, got %v", name, exp, act)}
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gaugeSeries returns a gauge time series with a point of each value, timestamped a second apart if timestamped is set
+func gaugeSeries(timestamped bool, values ...float64) *record {
+	r := &record{Name: name1, Type: gauge}
+	for i := range values {
+		p := point{Value: &values[i]}
+		if timestamped {
+			p.Timestamp = uint64(time.Duration(i+1) * time.Second)
+		}
+		r.Points = append(r.Points, p)
+	}
+	return r
+}
+
+// cumulativeHistogram returns a histogram of bounds 1 and 2 with the cumulative buckets the exporter writes
+func cumulativeHistogram(buckets ...uint64) *record {
+	return &record{Name: name1, Type: histogram, Sum: 10, Count: 6, Bounds: []float64{1, 2}, Buckets: buckets}
+}
+
+func summaryRecord(sum float64, quantiles ...quantile) *record {
+	return &record{Name: name1, Type: summary, Sum: sum, Count: 3, Quantiles: quantiles}
+}
+
+// writeRecords writes records to a data file at path
+func writeRecords(t *testing.T, path string, records ...*record) {
+	f, err := createDataFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := newDataWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records {
+		if err := w.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_compareRecords(t *testing.T) {
+	one, oneAndABit, oneAndAHalf := 1.0, 1+1e-12, 1.5
+	tests := []struct {
+		name string
+		exp  *record
+		act  *record
+		want []string
+	}{
+		{"equal", &record{Type: gauge, Value: &one}, &record{Type: gauge, Value: &one}, nil},
+		{"value_tolerance", &record{Type: gauge, Value: &one}, &record{Type: gauge, Value: &oneAndABit}, nil},
+		{"value", &record{Type: gauge, Value: &one}, &record{Type: gauge, Value: &oneAndAHalf},
+			[]string{"value: expected 1, got 1.5"}},
+		{"type", &record{Type: gauge, Value: &one}, &record{Type: counter, Value: &one},
+			[]string{"type: expected gauge, got counter"}},
+		{"missing_value", &record{Type: gauge, Value: &one}, &record{Type: gauge}, []string{"value: missing"}},
+		{"timestamp_same_millisecond", &record{Type: gauge, Value: &one, Timestamp: 1500000000},
+			&record{Type: gauge, Value: &one, Timestamp: 1500999999}, nil},
+		{"timestamp", &record{Type: gauge, Value: &one, Timestamp: 1500000000},
+			&record{Type: gauge, Value: &one, Timestamp: 1501000000}, []string{"timestamp: expected 1500 ms, got 1501 ms"}},
+		{"point", gaugeSeries(false, 1, 2, 3), gaugeSeries(false, 1, 5, 3), []string{"point 1: value: expected 2, got 5"}},
+		{"point_missing", gaugeSeries(true, 1, 2, 3), func() *record {
+			r := gaugeSeries(true, 1, 2, 3)
+			r.Points = append(r.Points[:1], r.Points[2])
+			return r
+		}(), []string{"points: expected 3, got 2", "point 1: no sample at 2000 ms"}},
+		{"point_unexpected", gaugeSeries(true, 1, 2, 3), gaugeSeries(true, 1, 2, 3, 4),
+			[]string{"points: expected 3, got 4", "unexpected sample at 4000 ms"}},
+		{"histogram", cumulativeHistogram(1, 3, 6), cumulativeHistogram(1, 3, 6), nil},
+		{"bucket_missing", cumulativeHistogram(1, 3, 6), &record{Type: histogram, Sum: 10, Count: 6,
+			Bounds: []float64{1}, Buckets: []uint64{1, 6}}, []string{"bucket le=2: missing"}},
+		{"bucket_unexpected", cumulativeHistogram(1, 3, 6), &record{Type: histogram, Sum: 10, Count: 6,
+			Bounds: []float64{1, 2, 5}, Buckets: []uint64{1, 3, 5, 6}}, []string{"bucket le=5: unexpected"}},
+		{"bucket_duplicate", cumulativeHistogram(1, 3, 6), &record{Type: histogram, Sum: 10, Count: 6,
+			Bounds: []float64{1, 1}, Buckets: []uint64{1, 1, 6}}, []string{"bucket le=1: duplicate", "bucket le=2: missing"}},
+		{"bucket_value", cumulativeHistogram(1, 3, 6), cumulativeHistogram(1, 4, 6),
+			[]string{"bucket le=2: expected 3, got 4"}},
+		{"individual_buckets", cumulativeHistogram(1, 3, 6), cumulativeHistogram(1, 2, 6), []string{
+			"bucket le=2: expected 3, got 2", "buckets: the count of each bucket, not the cumulative count",
+		}},
+		{"overflow_left_out", cumulativeHistogram(1, 3, 6), cumulativeHistogram(1, 3, 3), []string{
+			"bucket le=+Inf: expected 6, got 3", "+Inf bucket: leaves out the overflow bucket",
+		}},
+		{"overflow_counted_twice", cumulativeHistogram(1, 3, 6), cumulativeHistogram(1, 3, 9), []string{
+			"bucket le=+Inf: expected 6, got 9", "+Inf bucket: counts the overflow bucket twice",
+		}},
+		{"infinity_bucket", cumulativeHistogram(1, 3, 6), cumulativeHistogram(1, 3, 7),
+			[]string{"bucket le=+Inf: expected 6, got 7"}},
+		{"histogram_count", cumulativeHistogram(1, 3, 6), &record{Type: histogram, Sum: 10, Count: 7,
+			Bounds: []float64{1, 2}, Buckets: []uint64{1, 3, 6}}, []string{"count: expected 6, got 7"}},
+		{"summary", summaryRecord(1, quantile{0.5, 1}), summaryRecord(1, quantile{0.5, 1}), nil},
+		// quantiles are compared with a relative tolerance, and every other value with an absolute one
+		{"quantile_relative_tolerance", summaryRecord(1, quantile{0.5, 1e12}), summaryRecord(1, quantile{0.5, 1e12 + 1}), nil},
+		{"sum_absolute_tolerance", summaryRecord(1e12, quantile{0.5, 1}), summaryRecord(1e12+1, quantile{0.5, 1}),
+			[]string{"sum: expected 1e+12, got 1.000000000001e+12"}},
+		{"quantile_value", summaryRecord(1, quantile{0.5, 1}), summaryRecord(1, quantile{0.5, 1.001}),
+			[]string{"quantile 0.5: expected 1, got 1.001"}},
+		{"quantile_missing", summaryRecord(1, quantile{0.5, 1}), summaryRecord(1, quantile{0.9, 1}),
+			[]string{"quantile 0.5: missing", "quantile 0.9: unexpected"}},
+		{"quantile_order", summaryRecord(1, quantile{0.5, 1}, quantile{0.9, 2}),
+			summaryRecord(1, quantile{0.9, 2}, quantile{0.5, 1}), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareRecords(tt.exp, tt.act); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_compareSamples(t *testing.T) {
+	notAfter := gaugeSeries(true, 1, 2)
+	notAfter.Points[1].Timestamp = notAfter.Points[0].Timestamp
+	tests := []struct {
+		name string
+		exp  *record
+		act  *record
+		want []string
+	}{
+		{"in_order", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1, 2, 3), nil},
+		{"merged", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1, 1, 2, 2, 2, 3), nil},
+		{"repeated", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1, 2, 3, 1, 2, 3, 1), nil},
+		{"repeated_first_point_merged", gaugeSeries(false, 1, 2, 1), gaugeSeries(true, 1, 2, 1, 2, 1), nil},
+		{"value_tolerance", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1, 2+1e-12, 3), nil},
+		{"value", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1, 5, 3),
+			[]string{"sample 1: point 1: value: expected 2, got 5"}},
+		{"dropped", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1, 3), []string{"sample 1: point 1 dropped"}},
+		{"several_dropped", gaugeSeries(false, 1, 2, 3, 4), gaugeSeries(true, 1, 4),
+			[]string{"sample 1: points 1 to 2 dropped"}},
+		{"first_of_round_dropped", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1, 2, 3, 2),
+			[]string{"sample 3: point 0 dropped"}},
+		{"reordered", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1, 3, 2),
+			[]string{"sample 2: point 1 reordered after point 2"}},
+		{"came_back", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1, 2, 1, 3),
+			[]string{"sample 2: point 0 reordered after point 1"}},
+		{"last_dropped", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1, 2), []string{"point 2 dropped"}},
+		{"tail_dropped", gaugeSeries(false, 1, 2, 3), gaugeSeries(true, 1), []string{"points 1 to 2 dropped"}},
+		{"missing", gaugeSeries(false, 1, 2, 3), gaugeSeries(true), []string{"samples: missing"}},
+		{"not_after", gaugeSeries(false, 1, 2), notAfter, []string{"sample 1: timestamp 1000000000 is not after 1000000000"}},
+		{"type", gaugeSeries(false, 1), &record{Type: counter, Points: gaugeSeries(true, 1).Points},
+			[]string{"type: expected gauge, got counter"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareSamples(tt.exp, tt.act); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_exportBuckets(t *testing.T) {
+	tests := []struct {
+		name string
+		r    *record
+		want []uint64
+	}{
+		{"overflow_bucket", &record{Type: histogram, Count: 6, Bounds: []float64{1, 2}, Buckets: []uint64{1, 2, 3}},
+			[]uint64{1, 3, 6}},
+		{"no_overflow_bucket", &record{Type: histogram, Count: 3, Bounds: []float64{1, 2}, Buckets: []uint64{1, 2}},
+			[]uint64{1, 3, 3}},
+		{"no_bounds", &record{Type: histogram, Count: 3, Buckets: []uint64{3}}, []uint64{3}},
+		{"series", &record{Type: histogram, Bounds: []float64{1, 2}, Points: []point{
+			{Count: 6, Buckets: []uint64{1, 2, 3}}, {Count: 9, Buckets: []uint64{3, 3, 3}},
+		}}, []uint64{1, 3, 6, 3, 6, 9}},
+		{"summary", &record{Type: summary, Count: 3, Buckets: []uint64{1, 2}}, []uint64{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exportBuckets(tt.r)
+			var got []uint64
+			for i := range tt.r.points() {
+				got = append(got, tt.r.at(i).Buckets...)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkCumulativeBuckets(t *testing.T) {
+	tests := []struct {
+		name string
+		act  *record
+		want []string
+	}{
+		{"cumulative", cumulativeHistogram(1, 3, 6), nil},
+		{"decreasing", cumulativeHistogram(3, 1, 6), []string{"bucket le=2: 1 is less than 3 of le=1, not cumulative"}},
+		{"infinity_not_count", cumulativeHistogram(1, 3, 5), []string{"+Inf bucket: 5 is not the count 6"}},
+		{"infinity_missing", cumulativeHistogram(1, 3), nil},
+		{"series", &record{Type: histogram, Bounds: []float64{1, 2}, Points: []point{
+			{Count: 6, Buckets: []uint64{1, 3, 6}}, {Count: 6, Buckets: []uint64{3, 1, 6}},
+		}}, []string{"point 1: bucket le=2: 1 is less than 3 of le=1, not cumulative"}},
+		{"summary", summaryRecord(1, quantile{0.9, 1}, quantile{0.5, 2}), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkCumulativeBuckets(tt.act); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_compareTolerance(t *testing.T) {
+	tests := []struct {
+		name     string
+		compare  func(name string, exp, act, tolerance float64) []string
+		exp, act float64
+		want     bool
+	}{
+		{"absolute_within", compareValue, 100, 100.5, false},
+		{"absolute_at", compareValue, 100, 101, false},
+		{"absolute_beyond", compareValue, 100, 101.5, true},
+		{"relative_within", compareRelative, 100, 100.5, false},
+		{"relative_at", compareRelative, 100, 101, false},
+		{"relative_beyond", compareRelative, 100, 102, true},
+		{"relative_of_larger", compareRelative, 101, 100, false},
+		{"relative_zero", compareRelative, 0, 0, false},
+		{"relative_sign", compareRelative, 1, -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// an absolute tolerance of 1, or a relative one of 1%
+			tolerance := 1.0
+			if strings.HasPrefix(tt.name, "relative") {
+				tolerance = 0.01
+			}
+			if got := tt.compare("v", tt.exp, tt.act, tolerance); (len(got) > 0) != tt.want {
+				t.Errorf("got %q, want a mismatch %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_verify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input, output := filepath.Join(dir, "data.jsonl"), filepath.Join(dir, "ans.jsonl")
+
+	one, two := 1.0, 2.0
+	labels1, labels2 := map[string]string{label11: value11}, map[string]string{label11: value21}
+	writeRecords(t, input,
+		&record{Name: "passed", Type: gauge, Labels: labels1, Value: &one},
+		&record{Name: "counter", Type: counter, Value: &one},
+		&record{Name: "histogram", Type: histogram, Sum: 10, Count: 6, Bounds: []float64{1, 2}, Buckets: []uint64{1, 2, 3}},
+		&record{Name: "individual", Type: histogram, Sum: 10, Count: 6, Bounds: []float64{1, 2}, Buckets: []uint64{1, 2, 3}},
+		&record{Name: "value", Type: gauge, Value: &one},
+		&record{Name: "labels", Type: gauge, Labels: labels1, Value: &one},
+		&record{Name: "missing", Type: gauge, Value: &one},
+		&record{Name: "dropped", Type: counter, Temporality: "delta", Value: &one},
+		&record{Name: "leaked", Type: counter, Temporality: "delta", Value: &one},
+		&record{Name: "no_descriptor", Type: gauge, NoDescriptor: true, Value: &one},
+	)
+	writeRecords(t, output,
+		&record{Name: "passed", Type: gauge, Labels: labels1, Value: &one},
+		&record{Name: "counter_total", Type: counter, Value: &one},
+		&record{Name: "histogram", Type: histogram, Sum: 10, Count: 6, Bounds: []float64{1, 2}, Buckets: []uint64{1, 3, 6}},
+		&record{Name: "individual", Type: histogram, Sum: 10, Count: 6, Bounds: []float64{1, 2}, Buckets: []uint64{1, 2, 6}},
+		&record{Name: "value", Type: gauge, Value: &two},
+		&record{Name: "labels", Type: gauge, Labels: labels2, Value: &one},
+		&record{Name: "leaked_total", Type: counter, Value: &one},
+		&record{Name: "no_descriptor", Type: gauge, Value: &one},
+		&record{Name: "unexpected", Type: gauge, Value: &one},
+	)
+
+	err = verify(input, output)
+	var errs stageErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got %v, want stageErrors", err)
+	}
+	got := make(map[string]string)
+	for _, err := range errs {
+		var metricErr *metricError
+		if !errors.As(err, &metricErr) {
+			t.Fatalf("got %v, want a metricError", err)
+		}
+		got[metricErr.name] = metricErr.err.Error()
+	}
+	want := map[string]string{
+		"individual":    "bucket le=2: expected 3, got 2; buckets: the count of each bucket, not the cumulative count",
+		"value":         "value: expected 1, got 2",
+		"labels":        "labels: expected map[" + label11 + ":" + value11 + "], got map[" + label11 + ":" + value21 + "]",
+		"missing":       "missing from " + output,
+		"leaked_total":  "leaked through: expected the exporter to drop MONOTONIC_INT64 DELTA",
+		"no_descriptor": "leaked through: expected the exporter to drop a metric without a descriptor",
+		"unexpected":    "unexpected series on line 10 of " + output,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q,\nwant %q", got, want)
+	}
+}